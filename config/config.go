@@ -0,0 +1,629 @@
+// Package config holds the configuration of the syslog-gollector, which may
+// be loaded from a JSON, YAML or TOML file, and overridden by command-line
+// flags.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/otoolep/syslog-gollector/input"
+	"github.com/otoolep/syslog-gollector/pipeline"
+	"gopkg.in/yaml.v3"
+)
+
+const redacted = "********"
+
+// Config is the complete configuration of the program.
+type Config struct {
+	Admin      string      `json:"admin"`
+	Listeners  Listeners   `json:"listeners"`
+	Channels   Channels    `json:"channels"`
+	Parser     Parser      `json:"parser"`
+	RateLimits []RateLimit `json:"rate_limits"`
+	Filters    []Filter    `json:"filters"`
+	Sampling   []Sample    `json:"sampling"`
+	Redact     []Redact    `json:"redact"`
+	RedactKey  string      `json:"redact_key"`
+	Transform  Transform   `json:"transform"`
+	Dedup      Dedup       `json:"dedup"`
+	Routing    Routing     `json:"routing"`
+	Output     Output      `json:"output"`
+	DeadLetter DeadLetter  `json:"dead_letter"`
+	Silence    Silence     `json:"silence"`
+}
+
+// Listeners configures the interfaces on which Syslog messages are received.
+// An empty interface disables the listener.
+type Listeners struct {
+	TCP       string `json:"tcp"`
+	UDP       string `json:"udp"`
+	TCPAccess Access `json:"tcp_access"`
+	UDPAccess Access `json:"udp_access"`
+
+	TCPConnections Connections `json:"tcp_connections"`
+	TCPMultiline   Multiline   `json:"tcp_multiline"`
+}
+
+// Multiline configures how a TCP listener assembles messages spanning
+// several lines. A partial message is flushed after FlushTimeout
+// milliseconds without data. A message whose MSG starts with whitespace
+// (if Whitespace is set), starts with one of Prefixes, or matches one of
+// the Patterns is merged into the message before it, until that has
+// MaxLines lines.
+type Multiline struct {
+	FlushTimeout int      `json:"flush_timeout"`
+	MaxLines     int      `json:"max_lines"`
+	Whitespace   bool     `json:"whitespace"`
+	Prefixes     []string `json:"prefixes"`
+	Patterns     []string `json:"patterns"`
+}
+
+// Connections limits the connections a TCP listener accepts, in total and
+// from each IP address, and closes connections idle for IdleTimeout
+// seconds. Zero values are unlimited.
+type Connections struct {
+	Max         int `json:"max"`
+	MaxPerIP    int `json:"max_per_ip"`
+	IdleTimeout int `json:"idle_timeout"`
+}
+
+// Access configures which senders a listener accepts, as lists of CIDRs.
+// Senders in a denied network are rejected, and if any networks are
+// allowed, only senders in one of them are accepted.
+type Access struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+// Channels configures the channels connecting the pipeline stages. Policy
+// determines what happens when a channel is full, and is one of "block",
+// "drop-newest" or "drop-oldest".
+type Channels struct {
+	Capacity int    `json:"capacity"`
+	Policy   string `json:"policy"`
+}
+
+// Parser configures parsing of the Syslog header. If Ordered is set,
+// messages from each source are parsed in the order received. If Lenient is
+// set, messages which are not valid RFC5424 are parsed as far as possible.
+// Timestamps without a time zone are taken to be UTC, unless
+// RequireTimezone is set, when they are invalid. Timestamps are written in
+// UTC in TimestampLayout, and messages whose timestamp differs from when
+// they were received by more than MaxSkew seconds are counted. If Metadata
+// is set, parsed messages record where and when they were received.
+type Parser struct {
+	Enabled         bool   `json:"enabled"`
+	Workers         int    `json:"workers"`
+	Ordered         bool   `json:"ordered"`
+	Lenient         bool   `json:"lenient"`
+	RequireTimezone bool   `json:"require_timezone"`
+	TimestampLayout string `json:"timestamp_layout"`
+	MaxSkew         int    `json:"max_skew"`
+	Metadata        bool   `json:"metadata"`
+}
+
+// A RateLimit limits the rate of messages from each sender, host or app, as
+// determined by By, which is "peer", "host" or "app". Rate is in messages per
+// second, and up to Burst messages may be received at once. If CIDRs is set,
+// the limit only applies to senders in those networks. Action is "drop",
+// "sample", which keeps one in every Sample messages over the limit, or
+// "summary", which drops them but periodically reports how many.
+type RateLimit struct {
+	Name   string   `json:"name"`
+	By     string   `json:"by"`
+	CIDRs  []string `json:"cidrs"`
+	Rate   float64  `json:"rate"`
+	Burst  int      `json:"burst"`
+	Action string   `json:"action"`
+	Sample int      `json:"sample"`
+}
+
+// A Filter keeps or drops the messages it matches, according to Action,
+// which is "include" or "exclude". Fields maps the JSON names of parsed
+// message fields to regular expressions, which must match the whole value,
+// and Raw is a regular expression matched against the message as received.
+// Messages are filtered by the first rule which matches them.
+type Filter struct {
+	Name   string            `json:"name"`
+	Action string            `json:"action"`
+	Fields map[string]string `json:"fields"`
+	Raw    string            `json:"raw"`
+}
+
+// A Sample rule keeps a sample of the parsed messages for which every
+// regular expression in Fields matches the whole value of the named field --
+// either one in every Every messages, or each with a probability of Percent%.
+// Exactly one of Every or Percent must be set.
+type Sample struct {
+	Name    string            `json:"name"`
+	Fields  map[string]string `json:"fields"`
+	Every   int               `json:"every"`
+	Percent float64           `json:"percent"`
+}
+
+// A Redact rule replaces sensitive text in messages. Either Builtin names a
+// built-in detector, or Regex is a regular expression, of which only the
+// first group is replaced if it has any. Action is "mask" or "hash", which
+// replaces the text with its HMAC-SHA256 keyed by the RedactKey.
+type Redact struct {
+	Name    string `json:"name"`
+	Builtin string `json:"builtin"`
+	Regex   string `json:"regex"`
+	Action  string `json:"action"`
+}
+
+// RuleName returns the name of the rule at index i in its list, which is
+// the first of names which is set, or otherwise i. Every rule may be named,
+// and Redact rules default to the name of their built-in detector.
+func RuleName(i int, names ...string) string {
+	for _, name := range names {
+		if name != "" {
+			return name
+		}
+	}
+	return strconv.Itoa(i)
+}
+
+// Transform configures changes to the fields of parsed messages. Fields are
+// extracted from the message -- key=value pairs if KeyValue is set, and the
+// named groups of each regular expression in Regex -- and then fields are
+// renamed, added and dropped, in that order.
+type Transform struct {
+	KeyValue bool              `json:"key_value"`
+	Regex    []string          `json:"regex"`
+	Rename   map[string]string `json:"rename"`
+	Add      map[string]string `json:"add"`
+	Drop     []string          `json:"drop"`
+}
+
+// Dedup configures suppression of identical messages. Messages are
+// identical if the fields named in Key are equal, and only the first of
+// those received within Window seconds is written, followed by a summary,
+// "last message repeated N times", recording how many were suppressed. If
+// Window is 0, messages are not suppressed.
+type Dedup struct {
+	Window int      `json:"window"`
+	Key    []string `json:"key"`
+}
+
+// Routing configures which Kafka topic each message is written to.
+type Routing struct {
+	Rules []Route `json:"rules"`
+}
+
+// A Route writes messages matching the regular expression to the topic.
+type Route struct {
+	Match string `json:"match"`
+	Topic string `json:"topic"`
+}
+
+// Output configures where messages are written.
+type Output struct {
+	Kafka Kafka `json:"kafka"`
+}
+
+// Kafka configures the Kafka producer. BufferTime is in milliseconds.
+type Kafka struct {
+	Brokers     []string `json:"brokers"`
+	Topic       string   `json:"topic"`
+	Batch       int      `json:"batch"`
+	BufferTime  int      `json:"buffer_time"`
+	BufferBytes int      `json:"buffer_bytes"`
+}
+
+// DeadLetter configures where messages which cannot be parsed are written,
+// either a Kafka topic or a file. If neither is set, such messages are
+// dropped.
+type DeadLetter struct {
+	Topic string `json:"topic"`
+	File  string `json:"file"`
+}
+
+// Silence configures silent-host detection. Threshold is in seconds, and
+// if 0, detection is not enabled.
+type Silence struct {
+	Threshold int `json:"threshold"`
+	MinEvents int `json:"min_events"`
+}
+
+// Default returns the default configuration.
+func Default() *Config {
+	return &Config{
+		Admin: "localhost:8080",
+		Listeners: Listeners{
+			TCP: "localhost:514",
+			UDP: "localhost:514",
+
+			TCPMultiline: Multiline{FlushTimeout: 1000, MaxLines: 256},
+		},
+		Channels: Channels{Policy: "block"},
+		Parser: Parser{
+			Enabled:         true,
+			Workers:         1,
+			TimestampLayout: time.RFC3339Nano,
+			MaxSkew:         300,
+		},
+		Output: Output{
+			Kafka: Kafka{
+				Brokers:     []string{"localhost:9092"},
+				Topic:       "logs",
+				Batch:       10,
+				BufferTime:  1000,
+				BufferBytes: 512 * 1024,
+			},
+		},
+		Dedup:   Dedup{Key: []string{"host", "app", "message"}},
+		Silence: Silence{MinEvents: 10},
+	}
+}
+
+// Load overrides the configuration with the settings in the file at path.
+// Settings not present in the file are left unchanged. The format of the
+// file is determined by its extension, which must be one of .json, .yaml,
+// .yml or .toml. Settings not known to Config are an error.
+func (c *Config) Load(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	// Decode all formats to a generic form, and then via JSON, so the same
+	// field names and strict checking apply regardless of format.
+	var m map[string]interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		err = json.Unmarshal(b, &m)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(b, &m)
+	case ".toml":
+		err = toml.Unmarshal(b, &m)
+	default:
+		return fmt.Errorf("%s: unsupported configuration file format", path)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %s", path, err.Error())
+	}
+	if b, err = json.Marshal(m); err != nil {
+		return fmt.Errorf("%s: %s", path, err.Error())
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(c); err != nil {
+		return fmt.Errorf("%s: %s", path, err.Error())
+	}
+	return nil
+}
+
+// Flags registers command-line flags on fs for the settings which may be
+// set that way. Parsing fs sets the fields of c directly, so parsing again
+// after a file is loaded makes the flags override the values in that file.
+func (c *Config) Flags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Admin, "admin", c.Admin, "Admin interface")
+	fs.StringVar(&c.Listeners.TCP, "tcp", c.Listeners.TCP, "TCP bind interface. If set to empty string, not enabled")
+	fs.IntVar(&c.Listeners.TCPConnections.Max, "maxconns", c.Listeners.TCPConnections.Max, "maximum TCP connections. If 0, unlimited")
+	fs.IntVar(&c.Listeners.TCPConnections.MaxPerIP, "maxconnsperip", c.Listeners.TCPConnections.MaxPerIP, "maximum TCP connections from each IP address. If 0, unlimited")
+	fs.IntVar(&c.Listeners.TCPConnections.IdleTimeout, "idletimeout", c.Listeners.TCPConnections.IdleTimeout, "close TCP connections idle for this long (secs). If 0, never closed")
+	fs.IntVar(&c.Listeners.TCPMultiline.FlushTimeout, "flushtimeout", c.Listeners.TCPMultiline.FlushTimeout, "flush a partial TCP message after this long without data (ms)")
+	fs.StringVar(&c.Listeners.UDP, "udp", c.Listeners.UDP, "UDP interface. If set to empty string, not enabled")
+	fs.Var((*stringList)(&c.Output.Kafka.Brokers), "broker", "comma-delimited kafka brokers")
+	fs.StringVar(&c.Output.Kafka.Topic, "topic", c.Output.Kafka.Topic, "kafka topic")
+	fs.IntVar(&c.Output.Kafka.Batch, "batch", c.Output.Kafka.Batch, "Kafka batch size")
+	fs.IntVar(&c.Output.Kafka.BufferTime, "maxbuff", c.Output.Kafka.BufferTime, "Kafka client buffer max time (ms)")
+	fs.IntVar(&c.Output.Kafka.BufferBytes, "maxbytes", c.Output.Kafka.BufferBytes, "Kafka client buffer max bytes")
+	fs.BoolVar(&c.Parser.Enabled, "parse", c.Parser.Enabled, "enable syslog header parsing")
+	fs.IntVar(&c.Parser.Workers, "parseworkers", c.Parser.Workers, "number of parser goroutines")
+	fs.BoolVar(&c.Parser.Ordered, "parseordered", c.Parser.Ordered, "preserve order of messages from each source when parsing")
+	fs.BoolVar(&c.Parser.Lenient, "parselenient", c.Parser.Lenient, "parse messages which are not valid RFC5424 as far as possible")
+	fs.BoolVar(&c.Parser.RequireTimezone, "requiretz", c.Parser.RequireTimezone, "reject timestamps without a time zone, rather than taking them to be UTC")
+	fs.StringVar(&c.Parser.TimestampLayout, "timelayout", c.Parser.TimestampLayout, "layout, as used by Go's time package, in which parsed timestamps are written")
+	fs.BoolVar(&c.Parser.Metadata, "metadata", c.Parser.Metadata, "add where and when each message was received to parsed messages")
+	fs.IntVar(&c.Parser.MaxSkew, "maxskew", c.Parser.MaxSkew, "count messages whose timestamp is more than this far from receive time (secs). If 0, not counted")
+	fs.IntVar(&c.Channels.Capacity, "chancap", c.Channels.Capacity, "channel buffering capacity")
+	fs.StringVar(&c.Channels.Policy, "chanpolicy", c.Channels.Policy, "policy when a channel is full: block, drop-newest or drop-oldest")
+	fs.IntVar(&c.Dedup.Window, "dedup", c.Dedup.Window, "suppress identical messages received within this long (secs). If 0, not enabled")
+	fs.StringVar(&c.DeadLetter.Topic, "deadtopic", c.DeadLetter.Topic, "kafka topic for messages which cannot be parsed")
+	fs.StringVar(&c.DeadLetter.File, "deadfile", c.DeadLetter.File, "file for messages which cannot be parsed")
+	fs.IntVar(&c.Silence.Threshold, "silence", c.Silence.Threshold, "alert when a host is silent for this long (secs). If 0, not enabled")
+	fs.IntVar(&c.Silence.MinEvents, "silencemin", c.Silence.MinEvents, "events a host must send before silence is alerted")
+}
+
+// Validate checks the configuration, returning an error describing every
+// problem found.
+func (c *Config) Validate() error {
+	var problems []string
+	problem := func(field, format string, a ...interface{}) {
+		problems = append(problems, field+": "+fmt.Sprintf(format, a...))
+	}
+	checkFields := func(field string, fields map[string]string) {
+		for name, re := range fields {
+			if !input.IsField(name) {
+				problem(field+".fields", "unknown field %q", name)
+			} else if _, err := regexp.Compile(re); err != nil {
+				problem(field+".fields."+name, "%s", err)
+			}
+		}
+	}
+
+	if err := checkAddr(c.Admin); err != nil {
+		problem("admin", "%s", err)
+	}
+
+	if c.Listeners.TCP == "" && c.Listeners.UDP == "" {
+		problem("listeners", "at least one of tcp or udp must be set")
+	}
+	checkCIDRs := func(field string, cidrs []string) {
+		for _, cidr := range cidrs {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				problem(field, "%s", err)
+			}
+		}
+	}
+	if c.Listeners.TCPConnections.Max < 0 {
+		problem("listeners.tcp_connections.max", "must not be negative")
+	}
+	if c.Listeners.TCPConnections.MaxPerIP < 0 {
+		problem("listeners.tcp_connections.max_per_ip", "must not be negative")
+	}
+	if c.Listeners.TCPConnections.IdleTimeout < 0 {
+		problem("listeners.tcp_connections.idle_timeout", "must not be negative")
+	}
+	if c.Listeners.TCPMultiline.FlushTimeout <= 0 {
+		problem("listeners.tcp_multiline.flush_timeout", "must be positive")
+	}
+	if c.Listeners.TCPMultiline.MaxLines <= 0 {
+		problem("listeners.tcp_multiline.max_lines", "must be positive")
+	}
+	for i, re := range c.Listeners.TCPMultiline.Patterns {
+		if _, err := regexp.Compile(re); err != nil {
+			problem(fmt.Sprintf("listeners.tcp_multiline.patterns[%d]", i), "%s", err)
+		}
+	}
+	checkCIDRs("listeners.tcp_access.allow", c.Listeners.TCPAccess.Allow)
+	checkCIDRs("listeners.tcp_access.deny", c.Listeners.TCPAccess.Deny)
+	checkCIDRs("listeners.udp_access.allow", c.Listeners.UDPAccess.Allow)
+	checkCIDRs("listeners.udp_access.deny", c.Listeners.UDPAccess.Deny)
+	if c.Listeners.TCP != "" {
+		if err := checkAddr(c.Listeners.TCP); err != nil {
+			problem("listeners.tcp", "%s", err)
+		}
+	}
+	if c.Listeners.UDP != "" {
+		if err := checkAddr(c.Listeners.UDP); err != nil {
+			problem("listeners.udp", "%s", err)
+		}
+	}
+
+	if c.Channels.Capacity < 0 {
+		problem("channels.capacity", "must not be negative")
+	}
+	if p, err := input.ParsePolicy(c.Channels.Policy); err != nil {
+		problem("channels.policy", "%s", err)
+	} else if p != input.Block && c.Channels.Capacity == 0 {
+		problem("channels.policy", "%s requires a non-zero capacity", p)
+	}
+
+	if c.Parser.Workers < 1 {
+		problem("parser.workers", "must be at least 1")
+	}
+	if c.Parser.TimestampLayout == "" {
+		problem("parser.timestamp_layout", "must be set")
+	}
+	if c.Parser.MaxSkew < 0 {
+		problem("parser.max_skew", "must not be negative")
+	}
+
+	names := make(map[string]bool)
+	for i, r := range c.RateLimits {
+		field := fmt.Sprintf("rate_limits[%d]", i)
+		name := RuleName(i, r.Name)
+		if names[name] {
+			problem(field+".name", "%q is not unique", name)
+		}
+		names[name] = true
+		if r.By != pipeline.ByPeer && r.By != pipeline.ByHost && r.By != pipeline.ByApp {
+			problem(field+".by", "must be peer, host or app")
+		}
+		checkCIDRs(field+".cidrs", r.CIDRs)
+		if r.Rate <= 0 {
+			problem(field+".rate", "must be greater than 0")
+		}
+		if r.Burst < 1 {
+			problem(field+".burst", "must be at least 1")
+		}
+		if a, err := pipeline.ParseLimitAction(r.Action); err != nil {
+			problem(field+".action", "%s", err)
+		} else if a == pipeline.LimitSample && r.Sample < 1 {
+			problem(field+".sample", "must be at least 1")
+		}
+	}
+
+	names = make(map[string]bool)
+	for i, f := range c.Filters {
+		field := fmt.Sprintf("filters[%d]", i)
+		name := RuleName(i, f.Name)
+		if names[name] {
+			problem(field+".name", "%q is not unique", name)
+		}
+		names[name] = true
+		if f.Action != "include" && f.Action != "exclude" {
+			problem(field+".action", "must be include or exclude")
+		}
+		checkFields(field, f.Fields)
+		if _, err := regexp.Compile(f.Raw); err != nil {
+			problem(field+".raw", "%s", err)
+		}
+	}
+
+	names = make(map[string]bool)
+	for i, r := range c.Sampling {
+		field := fmt.Sprintf("sampling[%d]", i)
+		name := RuleName(i, r.Name)
+		if names[name] {
+			problem(field+".name", "%q is not unique", name)
+		}
+		names[name] = true
+		checkFields(field, r.Fields)
+		if r.Every < 0 {
+			problem(field+".every", "must not be negative")
+		}
+		if r.Percent < 0 || r.Percent > 100 {
+			problem(field+".percent", "must be between 0 and 100")
+		}
+		if (r.Every == 0) == (r.Percent == 0) {
+			problem(field, "exactly one of every or percent must be set")
+		}
+	}
+
+	names = make(map[string]bool)
+	hashed := false
+	for i, r := range c.Redact {
+		field := fmt.Sprintf("redact[%d]", i)
+		name := RuleName(i, r.Name, r.Builtin)
+		if names[name] {
+			problem(field+".name", "%q is not unique", name)
+		}
+		names[name] = true
+		if (r.Builtin == "") == (r.Regex == "") {
+			problem(field, "exactly one of builtin or regex must be set")
+		} else if _, ok := pipeline.Builtin(r.Builtin); r.Builtin != "" && !ok {
+			problem(field+".builtin", "unknown detector %q, must be one of credit_card, bearer_token or email", r.Builtin)
+		} else if _, err := regexp.Compile(r.Regex); err != nil {
+			problem(field+".regex", "%s", err)
+		}
+		if r.Action != "mask" && r.Action != "hash" {
+			problem(field+".action", "must be mask or hash")
+		}
+		hashed = hashed || r.Action == "hash"
+	}
+	if hashed && c.RedactKey == "" {
+		problem("redact_key", "must be set if any redact rule hashes")
+	}
+
+	for i, r := range c.Transform.Regex {
+		field := fmt.Sprintf("transform.regex[%d]", i)
+		if re, err := regexp.Compile(r); err != nil {
+			problem(field, "%s", err)
+		} else if !hasNamedGroup(re) {
+			problem(field, "has no named groups")
+		}
+	}
+	for from, to := range c.Transform.Rename {
+		if to == "" {
+			problem("transform.rename."+from, "must not be empty")
+		}
+	}
+
+	if c.Dedup.Window < 0 {
+		problem("dedup.window", "must not be negative")
+	}
+	if c.Dedup.Window > 0 && len(c.Dedup.Key) == 0 {
+		problem("dedup.key", "at least one field must be set")
+	}
+	for _, name := range c.Dedup.Key {
+		if !input.IsField(name) {
+			problem("dedup.key", "unknown field %q", name)
+		}
+	}
+
+	for i, r := range c.Routing.Rules {
+		field := fmt.Sprintf("routing.rules[%d]", i)
+		if _, err := regexp.Compile(r.Match); err != nil {
+			problem(field+".match", "%s", err)
+		}
+		if r.Topic == "" {
+			problem(field+".topic", "must be set")
+		}
+	}
+
+	k := c.Output.Kafka
+	if len(k.Brokers) == 0 {
+		problem("output.kafka.brokers", "at least one broker must be set")
+	}
+	for i, b := range k.Brokers {
+		if err := checkAddr(b); err != nil {
+			problem(fmt.Sprintf("output.kafka.brokers[%d]", i), "%s", err)
+		}
+	}
+	if k.Topic == "" {
+		problem("output.kafka.topic", "must be set")
+	}
+	if k.Batch <= 0 {
+		problem("output.kafka.batch", "must be greater than 0")
+	}
+	if k.BufferTime <= 0 {
+		problem("output.kafka.buffer_time", "must be greater than 0")
+	}
+	if k.BufferBytes <= 0 {
+		problem("output.kafka.buffer_bytes", "must be greater than 0")
+	}
+
+	if c.DeadLetter.Topic != "" && c.DeadLetter.File != "" {
+		problem("dead_letter", "only one of topic or file may be set")
+	}
+
+	if c.Silence.Threshold < 0 {
+		problem("silence.threshold", "must not be negative")
+	}
+	if c.Silence.MinEvents < 0 {
+		problem("silence.min_events", "must not be negative")
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// Redacted returns a copy of the configuration, with secrets masked.
+func (c *Config) Redacted() *Config {
+	r := *c
+	r.Routing.Rules = append([]Route(nil), c.Routing.Rules...)
+	r.Output.Kafka.Brokers = append([]string(nil), c.Output.Kafka.Brokers...)
+	if r.RedactKey != "" {
+		r.RedactKey = redacted
+	}
+	return &r
+}
+
+// hasNamedGroup returns whether the regular expression has any named groups.
+func hasNamedGroup(re *regexp.Regexp) bool {
+	for _, name := range re.SubexpNames() {
+		if name != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// checkAddr checks that addr is of the form host:port.
+func checkAddr(addr string) error {
+	_, _, err := net.SplitHostPort(addr)
+	return err
+}
+
+// stringList is a flag.Value for a comma-delimited list of strings.
+type stringList []string
+
+func (s *stringList) String() string {
+	if s == nil {
+		return ""
+	}
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(v string) error {
+	*s = strings.Split(v, ",")
+	return nil
+}
@@ -0,0 +1,140 @@
+package config
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "gopkg.in/check.v1"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+type ConfigSuite struct {
+	dir string
+}
+
+var _ = Suite(&ConfigSuite{})
+
+func (s *ConfigSuite) SetUpTest(c *C) {
+	s.dir = c.MkDir()
+}
+
+func (s *ConfigSuite) write(c *C, name, contents string) string {
+	path := filepath.Join(s.dir, name)
+	c.Assert(ioutil.WriteFile(path, []byte(contents), 0644), IsNil)
+	return path
+}
+
+func (s *ConfigSuite) Test_DefaultValid(c *C) {
+	c.Assert(Default().Validate(), IsNil)
+}
+
+func (s *ConfigSuite) Test_LoadFormats(c *C) {
+	files := map[string]string{
+		"c.json": `{"listeners": {"udp": ""}, "output": {"kafka": {"topic": "syslog", "brokers": ["k1:9092", "k2:9092"]}}}`,
+		"c.yaml": "listeners:\n  udp: \"\"\noutput:\n  kafka:\n    topic: syslog\n    brokers: [k1:9092, k2:9092]\n",
+		"c.toml": "[listeners]\nudp = \"\"\n[output.kafka]\ntopic = \"syslog\"\nbrokers = [\"k1:9092\", \"k2:9092\"]\n",
+	}
+	for name, contents := range files {
+		cfg := Default()
+		c.Assert(cfg.Load(s.write(c, name, contents)), IsNil)
+		c.Assert(cfg.Listeners.TCP, Equals, "localhost:514")
+		c.Assert(cfg.Listeners.UDP, Equals, "")
+		c.Assert(cfg.Output.Kafka.Topic, Equals, "syslog")
+		c.Assert(cfg.Output.Kafka.Brokers, DeepEquals, []string{"k1:9092", "k2:9092"})
+		c.Assert(cfg.Output.Kafka.Batch, Equals, 10)
+	}
+}
+
+func (s *ConfigSuite) Test_LoadUnknownField(c *C) {
+	err := Default().Load(s.write(c, "c.json", `{"output": {"kafka": {"topics": "syslog"}}}`))
+	c.Assert(err, ErrorMatches, `.*unknown field "topics".*`)
+}
+
+func (s *ConfigSuite) Test_LoadUnsupportedFormat(c *C) {
+	err := Default().Load(s.write(c, "c.ini", "topic=syslog"))
+	c.Assert(err, ErrorMatches, ".*unsupported configuration file format")
+}
+
+func (s *ConfigSuite) Test_LoadMissing(c *C) {
+	err := Default().Load(filepath.Join(s.dir, "missing.json"))
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+func (s *ConfigSuite) Test_FlagsOverrideFile(c *C) {
+	cfg := Default()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cfg.Flags(fs)
+	args := []string{"-topic", "flagged", "-broker", "a:1,b:2"}
+
+	c.Assert(fs.Parse(args), IsNil)
+	c.Assert(cfg.Load(s.write(c, "c.json", `{"output": {"kafka": {"topic": "syslog", "batch": 50}}}`)), IsNil)
+	c.Assert(fs.Parse(args), IsNil)
+
+	c.Assert(cfg.Output.Kafka.Topic, Equals, "flagged")
+	c.Assert(cfg.Output.Kafka.Brokers, DeepEquals, []string{"a:1", "b:2"})
+	c.Assert(cfg.Output.Kafka.Batch, Equals, 50)
+}
+
+func (s *ConfigSuite) Test_Validate(c *C) {
+	cfg := Default()
+	cfg.Listeners.TCP = ""
+	cfg.Listeners.UDP = ""
+	cfg.Listeners.UDPAccess.Deny = []string{"10.0.0.1"}
+	cfg.Listeners.TCPConnections.IdleTimeout = -1
+	cfg.Listeners.TCPMultiline = Multiline{Patterns: []string{"("}}
+	cfg.Output.Kafka.Brokers = []string{"nope"}
+	cfg.Output.Kafka.Batch = 0
+	cfg.Routing.Rules = []Route{{Match: "(", Topic: ""}}
+	cfg.Channels.Policy = "drop-oldest"
+	cfg.Parser.TimestampLayout = ""
+	cfg.RateLimits = []RateLimit{
+		{By: "sender", CIDRs: []string{"10.0.0.0/33"}, Rate: 0, Burst: 0, Action: "sample"},
+	}
+	cfg.Filters = []Filter{
+		{Action: "drop", Fields: map[string]string{"severity": "(", "colour": "red"}},
+		{Name: "0", Action: "exclude", Raw: "["},
+	}
+	cfg.Redact = []Redact{
+		{Builtin: "ssn", Action: "mask"},
+		{Regex: "password=(\\S+)", Action: "scramble"},
+		{Builtin: "email", Regex: "@", Action: "hash"},
+	}
+	cfg.Sampling = []Sample{{Every: 10, Percent: 5, Fields: map[string]string{"app": "("}}}
+	cfg.Dedup = Dedup{Window: 10, Key: []string{"hostname"}}
+	cfg.Transform.Regex = []string{"user=(\\w+)"}
+
+	err := cfg.Validate()
+	c.Assert(err, NotNil)
+	for _, field := range []string{"listeners:", "listeners.udp_access.deny:", "listeners.tcp_connections.idle_timeout:", "listeners.tcp_multiline.flush_timeout:", "listeners.tcp_multiline.max_lines:", "listeners.tcp_multiline.patterns[0]:",
+		"channels.policy:", "parser.timestamp_layout:", "rate_limits[0].by:", "rate_limits[0].cidrs:", "rate_limits[0].rate:",
+		"rate_limits[0].burst:", "rate_limits[0].sample:", "filters[0].action:", "filters[0].fields.severity:",
+		"filters[0].fields:", "filters[1].name:", "filters[1].raw:", "redact[0].builtin:", "redact[1].action:", "redact[2]:", "redact_key:", "transform.regex[0]:", "dedup.key:", "sampling[0]:", "sampling[0].fields.app:", "output.kafka.brokers[0]:", "output.kafka.batch:",
+		"routing.rules[0].match:", "routing.rules[0].topic:"} {
+		c.Assert(strings.Contains(err.Error(), field), Equals, true, Commentf("missing %s", field))
+	}
+}
+
+func (s *ConfigSuite) Test_Redacted(c *C) {
+	cfg := Default()
+	cfg.RedactKey = "key"
+
+	r := cfg.Redacted()
+	c.Assert(r.RedactKey, Equals, redacted)
+	c.Assert(cfg.RedactKey, Equals, "key")
+}
+
+func (s *ConfigSuite) Test_RuleName(c *C) {
+	c.Assert(RuleName(3), Equals, "3")
+	c.Assert(RuleName(3, ""), Equals, "3")
+	c.Assert(RuleName(3, "noisy"), Equals, "noisy")
+	c.Assert(RuleName(3, "", "email"), Equals, "email")
+	c.Assert(RuleName(3, "contacts", "email"), Equals, "contacts")
+}
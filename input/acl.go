@@ -0,0 +1,38 @@
+package input
+
+import "net"
+
+// An ACL determines which senders a server accepts messages from. Senders in
+// any denied network are rejected. If any networks are allowed, only senders
+// in one of them are accepted.
+type ACL struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// NewACL returns an ACL allowing and denying the given networks.
+func NewACL(allow, deny []*net.IPNet) *ACL {
+	return &ACL{allow: allow, deny: deny}
+}
+
+// Permits returns whether the ACL accepts messages from ip. A nil ACL
+// accepts every sender.
+func (a *ACL) Permits(ip net.IP) bool {
+	if a == nil {
+		return true
+	}
+	for _, n := range a.deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(a.allow) == 0 {
+		return true
+	}
+	for _, n := range a.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
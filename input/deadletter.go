@@ -0,0 +1,22 @@
+package input
+
+import "time"
+
+// A DeadLetter wraps a message which could not be processed, with where and
+// when it was received, and why it failed.
+type DeadLetter struct {
+	Raw      string    `json:"raw"`
+	Source   string    `json:"source"`
+	Received time.Time `json:"received"`
+	Reason   string    `json:"reason"`
+}
+
+// NewDeadLetter returns a DeadLetter for the Event.
+func NewDeadLetter(e *Event, reason string) *DeadLetter {
+	return &DeadLetter{
+		Raw:      e.Raw,
+		Source:   e.Source,
+		Received: e.Received,
+		Reason:   reason,
+	}
+}
@@ -1,100 +1,198 @@
 package input
 
 import (
+	"bytes"
+	"context"
 	"io"
-	"regexp"
 	"strings"
 )
 
 const (
+	// SYSLOG_DELIMITER matches the header starting each Syslog message,
+	// which the Delimiter looks for at the start of each line.
 	SYSLOG_DELIMITER = `<[0-9]{1,3}>[0-9]\s`
-)
 
-var syslogRegex *regexp.Regexp
-var startRegex *regexp.Regexp
-var runRegex *regexp.Regexp
+	// Lengths of the shortest and longest headers, "<1>1 " and "<123>1 ".
+	minHeaderLen = 5
+	maxHeaderLen = 7
+)
 
 // Reader is the interface objects passed to the Delimiter must support.
 type Reader interface {
 	ReadByte() (byte, error)
 }
 
-func init() {
-	syslogRegex = regexp.MustCompile(SYSLOG_DELIMITER)
-	startRegex = regexp.MustCompile(SYSLOG_DELIMITER + `$`)
-	runRegex = regexp.MustCompile(`\n` + SYSLOG_DELIMITER)
-}
+// delimiterState is the state of a Delimiter.
+type delimiterState int
+
+const (
+	// seeking discards bytes until a header is found. A Delimiter starts
+	// in this state, and returns to it whenever it is flushed.
+	seeking delimiterState = iota
 
-// A Delimiter detects when Syslog lines start.
+	// inMessage appends bytes to the current message, until a line
+	// starting with a header completes it.
+	inMessage
+)
+
+// A Delimiter detects when Syslog lines start. It is a state machine: it
+// starts seeking a header, discarding any bytes before it, and then
+// buffers the message until a line starting with another header completes
+// it. Vestige flushes the Delimiter, returning it to seeking a header.
 type Delimiter struct {
-	buffer []byte
-	regex  *regexp.Regexp
+	state     delimiterState
+	buffer    []byte
+	lineStart int // Index in buffer of the start of the current line
 }
 
-// NewDelimiter returns an initialized Delimiter.
+// NewDelimiter returns an initialized Delimiter. maxSize is the size of
+// message it expects, though larger messages are still delimited.
 func NewDelimiter(maxSize int) *Delimiter {
-	d := &Delimiter{}
-	d.buffer = make([]byte, 0, maxSize)
-	d.regex = startRegex
-	return d
+	return &Delimiter{buffer: make([]byte, 0, maxSize)}
 }
 
 // Push a byte into the Delimiter. If the byte results in a
 // a new Syslog message, it'll be flagged via the bool.
 func (d *Delimiter) Push(b byte) (string, bool) {
 	d.buffer = append(d.buffer, b)
-	delimiter := d.regex.FindIndex(d.buffer)
-	if delimiter == nil {
+
+	switch d.state {
+	case seeking:
+		n := headerSuffix(d.buffer)
+		if n == 0 {
+			// Only the bytes which could start a header are kept.
+			if len(d.buffer) >= maxHeaderLen {
+				d.buffer = append(d.buffer[:0], d.buffer[len(d.buffer)-maxHeaderLen+1:]...)
+			}
+			return "", false
+		}
+		d.buffer = append(d.buffer[:0], d.buffer[len(d.buffer)-n:]...)
+		d.state, d.lineStart = inMessage, 0
 		return "", false
-	}
 
-	if d.regex == startRegex {
-		// First match -- switch to the regex for embedded lines, and
-		// drop any leading characters.
-		d.buffer = d.buffer[delimiter[0]:]
-		d.regex = runRegex
+	default:
+		line := d.buffer[d.lineStart:]
+		if d.lineStart > 0 && len(line) >= minHeaderLen && len(line) <= maxHeaderLen && headerSuffix(line) == len(line) {
+			dispatch := strings.TrimRight(string(d.buffer[:d.lineStart-1]), "\r")
+			d.buffer = append(d.buffer[:0], line...)
+			d.lineStart = 0
+			return dispatch, true
+		}
+		if b == '\n' {
+			d.lineStart = len(d.buffer)
+		}
 		return "", false
 	}
-
-	dispatch := strings.TrimRight(string(d.buffer[:delimiter[0]]), "\r")
-	d.buffer = d.buffer[delimiter[0]+1:]
-	return dispatch, true
 }
 
-// Vestige returns the bytes which have been pushed to Delimiter, since
-// the last Syslog message was returned, but only if the buffer appears
-// to be a valid syslog message.
+// Vestige flushes the Delimiter, returning the bytes which have been
+// pushed since the last Syslog message was returned, but only if they
+// start with a Syslog header. It is called when no more bytes are expected
+// soon, such as when a read times out. The Delimiter then seeks a header
+// again, so any bytes pushed before the next header are discarded, except
+// for the start of a header split across the flush.
 func (d *Delimiter) Vestige() (string, bool) {
-	delimiter := syslogRegex.FindIndex(d.buffer)
-	if delimiter == nil {
-		d.buffer = nil
-		return "", false
+	dispatch, match := "", d.state == inMessage
+	if match {
+		dispatch = strings.TrimRight(string(d.buffer), "\r\n")
+		d.buffer = d.buffer[:0]
+	} else {
+		n := headerPrefix(d.buffer)
+		d.buffer = append(d.buffer[:0], d.buffer[len(d.buffer)-n:]...)
 	}
-	dispatch := strings.TrimRight(string(d.buffer), "\r\n")
-	d.buffer = nil
-	return dispatch, true
+	d.state, d.lineStart = seeking, 0
+	return dispatch, match
 }
 
-// Stream returns a channel, on which the delimited Syslog messages
-// are emitted.
-func (d *Delimiter) Stream(reader Reader) chan string {
+// headerPrefix returns the length of the start of a Syslog header which b
+// ends with, such as "<12" or "<12>1", or 0 if it does not end with one.
+func headerPrefix(b []byte) int {
+	i := bytes.LastIndexByte(b, '<')
+	if i < 0 {
+		return 0
+	}
+	s := b[i+1:]
+	digits := 0
+	for digits < len(s) && digits < 3 && isDigit(s[digits]) {
+		digits++
+	}
+	s = s[digits:]
+	if len(s) > 0 {
+		if digits == 0 || s[0] != '>' {
+			return 0
+		}
+		s = s[1:]
+	}
+	if len(s) > 0 && isDigit(s[0]) {
+		s = s[1:]
+	}
+	if len(s) > 0 {
+		return 0
+	}
+	return len(b) - i
+}
+
+// headerSuffix returns the length of the Syslog header which b ends with,
+// or 0 if it does not end with one.
+func headerSuffix(b []byte) int {
+	n := len(b)
+	if n < minHeaderLen || !isSpace(b[n-1]) || !isDigit(b[n-2]) || b[n-3] != '>' {
+		return 0
+	}
+	for i := n - 4; i >= 0 && i >= n-7; i-- {
+		switch {
+		case b[i] == '<' && i < n-4:
+			return n - i
+		case !isDigit(b[i]):
+			return 0
+		}
+	}
+	return 0
+}
+
+func isDigit(b byte) bool {
+	return '0' <= b && b <= '9'
+}
+
+// Stream returns a channel, on which the delimited Syslog messages read
+// from reader are emitted. The channel is closed when reader returns an
+// error, or ctx is done. If the error is not io.EOF, it is passed to errf,
+// if errf is not nil, before the channel is closed, even if ctx is done.
+// Either way the last message is complete, and is emitted first. Once ctx
+// is done no more messages are emitted, though a read already blocked is
+// not interrupted.
+func (d *Delimiter) Stream(ctx context.Context, reader Reader, errf func(error)) chan string {
 	eventChan := make(chan string)
 
+	// emit returns whether event was emitted before ctx was done.
+	emit := func(event string) bool {
+		select {
+		case eventChan <- event:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
 	go func() {
+		defer close(eventChan)
 		for {
+			if ctx.Err() != nil {
+				return
+			}
 			b, err := reader.ReadByte()
 			if err != nil {
-				if err != io.EOF {
-					panic(err)
-				} else {
-					close(eventChan)
-					return
+				if event, match := d.Vestige(); match {
+					emit(event)
+				}
+				if err != io.EOF && errf != nil {
+					errf(err)
 				}
+				return
 			}
 
-			event, match := d.Push(b)
-			if match {
-				eventChan <- event
+			if event, match := d.Push(b); match && !emit(event) {
+				return
 			}
 		}
 	}()
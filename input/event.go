@@ -0,0 +1,69 @@
+package input
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+const (
+	// Synthetic events are logged as facility syslog, severity warning.
+	syntheticPriority = 5*8 + 4
+	syntheticApp      = "syslog-gollector"
+)
+
+// An Event is a Syslog message passing through the pipeline, along with
+// where and when it was received.
+type Event struct {
+	Raw      string
+	Source   string // Remote address, empty if generated locally
+	Received time.Time
+	Listener string // Address of the listener, as configured
+	Protocol string // "tcp" or "udp"
+
+	// Set if the message has been parsed.
+	Parsed *ParsedMessage
+
+	// Set if the fields of the parsed message have been changed, in which
+	// case they are written instead of Parsed.
+	Fields map[string]interface{}
+}
+
+// NewEvent returns an Event for a message received now from source.
+func NewEvent(raw, source string) *Event {
+	return &Event{Raw: raw, Source: source, Received: time.Now()}
+}
+
+// NewSyntheticEvent returns an Event for a message generated by the program
+// itself at the given time, formatted as RFC5424.
+func NewSyntheticEvent(now time.Time, msg string) *Event {
+	return NewEvent(syntheticMessage(now, msg), "")
+}
+
+// syntheticMessage returns msg as an RFC5424 message from the program.
+func syntheticMessage(now time.Time, msg string) string {
+	return fmt.Sprintf("<%d>1 %s %s %s %d - %s",
+		syntheticPriority, now.Format(time.RFC3339), hostname(), syntheticApp, os.Getpid(), msg)
+}
+
+// hostname returns the hostname of the collector, or "-" if it is unknown.
+func hostname() string {
+	h, err := os.Hostname()
+	if err != nil {
+		return "-"
+	}
+	return h
+}
+
+// Encode returns the Event as written to the output -- the parsed message
+// as JSON if the message was parsed, otherwise the message as received.
+func (e *Event) Encode() ([]byte, error) {
+	if e.Fields != nil {
+		return json.Marshal(e.Fields)
+	}
+	if e.Parsed == nil {
+		return []byte(e.Raw), nil
+	}
+	return json.Marshal(e.Parsed)
+}
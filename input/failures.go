@@ -0,0 +1,39 @@
+package input
+
+import "sync"
+
+// Failures is a ring buffer of the most recent messages which failed
+// processing.
+type Failures struct {
+	mu    sync.Mutex
+	ring  []*DeadLetter
+	next  int
+	count int
+}
+
+// NewFailures returns a Failures retaining up to size messages.
+func NewFailures(size int) *Failures {
+	return &Failures{ring: make([]*DeadLetter, size)}
+}
+
+// Add records a failed message, discarding the oldest if full.
+func (f *Failures) Add(d *DeadLetter) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.ring[f.next] = d
+	f.next = (f.next + 1) % len(f.ring)
+	if f.count < len(f.ring) {
+		f.count++
+	}
+}
+
+// Recent returns the failed messages retained, oldest first.
+func (f *Failures) Recent() []DeadLetter {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	recent := make([]DeadLetter, 0, f.count)
+	for i := 0; i < f.count; i++ {
+		recent = append(recent, *f.ring[(f.next-f.count+i+len(f.ring))%len(f.ring)])
+	}
+	return recent
+}
@@ -2,25 +2,34 @@ package input
 
 import (
 	"bufio"
+	"io"
 	"log"
 	"net"
 	"strings"
+	"sync"
 	"time"
 
 	metrics "github.com/rcrowley/go-metrics"
 )
 
 const (
-	newlineTimeout = time.Duration(1000 * time.Millisecond)
-	msgBufSize     = 256
+	msgBufSize = 256
 )
 
 // A server captures attributes common to all servers.
 type server struct {
 	iface    string
+	protocol string
 	registry metrics.Registry
 	eventsRx metrics.Counter
 	bytesRx  metrics.Counter
+	peers    *PeerTracker
+
+	mu     sync.Mutex
+	acl    *ACL
+	addr   net.Addr
+	closer io.Closer
+	done   chan struct{}
 }
 
 // Statistics returns an object storing statistics, which supports JSON
@@ -29,76 +38,296 @@ func (s *server) Statistics() (metrics.Registry, error) {
 	return s.registry, nil
 }
 
+// Addr returns the address the server is bound to, or nil if the server
+// has not been started.
+func (s *server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.addr
+}
+
+// started records that the server is bound to addr, and that c must be
+// closed to stop it. The returned channel is closed when the server stops.
+func (s *server) started(addr net.Addr, c io.Closer) chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.addr = addr
+	s.closer = c
+	s.done = make(chan struct{})
+	return s.done
+}
+
+// Stop instructs the server to stop receiving. For a TcpServer, connections
+// already accepted are unaffected, and are closed by the remote host.
+func (s *server) Stop() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closer == nil {
+		return nil
+	}
+	close(s.done)
+	err := s.closer.Close()
+	s.addr = nil
+	s.closer = nil
+	return err
+}
+
+// stopped returns whether done has been closed.
+func stopped(done chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	default:
+		return false
+	}
+}
+
+// SetACL sets the ACL determining which senders the server accepts. It may
+// be called while the server is running.
+func (s *server) SetACL(a *ACL) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.acl = a
+}
+
+// permits returns whether the server accepts messages from ip.
+func (s *server) permits(ip net.IP) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.acl.Permits(ip)
+}
+
+// newEvent returns an Event for a message received by the server now from
+// source.
+func (s *server) newEvent(raw, source string) *Event {
+	e := NewEvent(raw, source)
+	e.Listener = s.iface
+	e.Protocol = s.protocol
+	return e
+}
+
+// Peers returns the tracker recording the activity of each remote host.
+func (s *server) Peers() *PeerTracker {
+	return s.peers
+}
+
 // A TcpServer binds to the supplied interface and receives Syslog messages.
 type TcpServer struct {
 	server
-	connectionsActive metrics.Counter
+	limits    TcpLimits
+	multiline Multiline
+	perIP     map[string]int // Open connections from each IP
+
+	connectionsActive   metrics.Counter
+	connectionsRejected metrics.Counter
+	connectionsLimited  metrics.Counter
+	connectionsIdle     metrics.Counter
+	eventsMerged        metrics.Counter
+	eventsRecovered     metrics.Counter
+}
+
+// TcpLimits limits the connections a TcpServer accepts, in total and from
+// each IP address, and closes connections idle for longer than IdleTimeout.
+// Zero values are unlimited.
+type TcpLimits struct {
+	MaxConnections int
+	MaxPerIP       int
+	IdleTimeout    time.Duration
 }
 
 // NewTcpServer returns a TCP server.
 func NewTcpServer(iface string) *TcpServer {
 	s := &TcpServer{}
 	s.iface = iface
+	s.protocol = "tcp"
+	s.peers = NewPeerTracker()
+	s.perIP = make(map[string]int)
 
 	s.registry = metrics.NewRegistry()
 	s.eventsRx = metrics.NewCounter()
 	s.bytesRx = metrics.NewCounter()
 	s.connectionsActive = metrics.NewCounter()
+	s.connectionsRejected = metrics.NewCounter()
+	s.connectionsLimited = metrics.NewCounter()
+	s.connectionsIdle = metrics.NewCounter()
+	s.eventsMerged = metrics.NewCounter()
+	s.eventsRecovered = metrics.NewCounter()
 	s.registry.Register("events.received", s.eventsRx)
 	s.registry.Register("events.bytes.received", s.bytesRx)
 	s.registry.Register("connections.Active", s.connectionsActive)
+	s.registry.Register("connections.rejected", s.connectionsRejected)
+	s.registry.Register("connections.rejected.limit", s.connectionsLimited)
+	s.registry.Register("connections.closed.idle", s.connectionsIdle)
+	s.registry.Register("events.merged", s.eventsMerged)
+	s.registry.Register("events.recovered", s.eventsRecovered)
 
 	return s
 }
 
+// SetLimits sets the TcpLimits applied by the TcpServer. It may be called
+// while the server is running, but connections already accepted are not
+// closed if over the new limits.
+func (s *TcpServer) SetLimits(l TcpLimits) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limits = l
+}
+
+// SetMultiline sets how the TcpServer assembles messages spanning several
+// lines. It may be called while the server is running, but connections
+// already accepted are unaffected.
+func (s *TcpServer) SetMultiline(m Multiline) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.multiline = m
+}
+
+// currentMultiline returns the Multiline settings for a new connection.
+func (s *TcpServer) currentMultiline() Multiline {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.multiline
+}
+
+// admit returns whether a connection from ip is within the limits, and if
+// so counts it as open.
+func (s *TcpServer) admit(ip string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.limits.MaxConnections > 0 && s.connectionsActive.Count() >= int64(s.limits.MaxConnections) {
+		return false
+	}
+	if s.limits.MaxPerIP > 0 && s.perIP[ip] >= s.limits.MaxPerIP {
+		return false
+	}
+	s.perIP[ip]++
+	s.connectionsActive.Inc(1)
+	return true
+}
+
+// release counts a connection from ip as closed.
+func (s *TcpServer) release(ip string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.perIP[ip]--; s.perIP[ip] <= 0 {
+		delete(s.perIP, ip)
+	}
+	s.connectionsActive.Dec(1)
+}
+
+// idleTimeout returns how long a connection may be idle before it is closed.
+func (s *TcpServer) idleTimeout() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.limits.IdleTimeout
+}
+
 // Start instructs the TcpServer to bind to the interface and accept connections.
-func (s *TcpServer) Start(f func() chan<- string) error {
+func (s *TcpServer) Start(f func(*Event)) error {
 	ln, err := net.Listen("tcp", s.iface)
 	if err != nil {
 		return err
 	}
+	done := s.started(ln.Addr(), ln)
 
 	go func() {
 		for {
 			conn, err := ln.Accept()
 			if err != nil {
+				if stopped(done) {
+					return
+				}
 				log.Println("failed to accept connection", err)
 				continue
 			}
+			ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+			if !s.permits(net.ParseIP(ip)) {
+				s.connectionsRejected.Inc(1)
+				conn.Close()
+				continue
+			}
+			if !s.admit(ip) {
+				s.connectionsLimited.Inc(1)
+				conn.Close()
+				continue
+			}
 			log.Println("accepted new connection from", conn.RemoteAddr().String())
-			go s.handleConnection(conn, f)
+			go func() {
+				defer s.release(ip)
+				s.handleConnection(conn, f)
+			}()
 		}
 	}()
 	return nil
 }
 
-func (s *TcpServer) handleConnection(conn net.Conn, f func() chan<- string) {
-	s.connectionsActive.Inc(1)
+func (s *TcpServer) handleConnection(conn net.Conn, f func(*Event)) {
 	defer conn.Close()
-	defer s.connectionsActive.Dec(1)
 
+	multiline := s.currentMultiline()
+	flushTimeout := multiline.flushTimeout()
+	joiner := newJoiner(multiline, s.eventsMerged)
 	delimiter := NewDelimiter(msgBufSize)
 	reader := bufio.NewReader(conn)
 	var event string
-	var match bool
+	var match, flush, idle bool
+	lastRead := time.Now()
+
+	emit := func(event string) {
+		s.eventsRx.Inc(1)
+		s.bytesRx.Inc(int64(len(event)))
+		e := s.newEvent(event, conn.RemoteAddr().String())
+		s.peers.Seen(e.Source, len(event), e.Received)
+		f(e)
+	}
+	// Messages held back by the joiner are emitted however the connection
+	// ends.
+	defer func() {
+		if event, ok := joiner.flush(); ok {
+			emit(event)
+		}
+	}()
 
 	for {
-		conn.SetReadDeadline(time.Now().Add(newlineTimeout))
+		conn.SetReadDeadline(time.Now().Add(flushTimeout))
 		b, err := reader.ReadByte()
 		if err != nil {
 			if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
 				event, match = delimiter.Vestige()
+				flush = true
+				timeout := s.idleTimeout()
+				idle = timeout > 0 && time.Since(lastRead) > timeout
 			} else {
 				log.Println("Error from connection:", err)
+				// The sender will send no more, so the last message is
+				// complete.
+				if event, ok := delimiter.Vestige(); ok {
+					s.eventsRecovered.Inc(1)
+					if event, ok := joiner.push(event); ok {
+						emit(event)
+					}
+				}
 				return
 			}
 		} else {
+			lastRead = time.Now()
 			event, match = delimiter.Push(b)
 		}
 		if match {
-			s.eventsRx.Inc(1)
-			s.bytesRx.Inc(int64(len(event)))
-			f() <- event
+			if event, ok := joiner.push(event); ok {
+				emit(event)
+			}
+		}
+		if flush {
+			if event, ok := joiner.flush(); ok {
+				emit(event)
+			}
+			flush = false
+		}
+		if idle {
+			log.Println("closing idle connection from", conn.RemoteAddr().String())
+			s.connectionsIdle.Inc(1)
+			return
 		}
 	}
 }
@@ -106,7 +335,8 @@ func (s *TcpServer) handleConnection(conn net.Conn, f func() chan<- string) {
 // A UdpServer listens to the supplied interface and receives Syslog messages.
 type UdpServer struct {
 	server
-	udpAddr *net.UDPAddr
+	udpAddr         *net.UDPAddr
+	packetsRejected metrics.Counter
 }
 
 // NewUdpServer returns a UDP server.
@@ -118,35 +348,50 @@ func NewUdpServer(iface string) *UdpServer {
 
 	s := &UdpServer{}
 	s.iface = iface
+	s.protocol = "udp"
 	s.udpAddr = addr
+	s.peers = NewPeerTracker()
 
 	s.registry = metrics.NewRegistry()
 	s.eventsRx = metrics.NewCounter()
 	s.bytesRx = metrics.NewCounter()
+	s.packetsRejected = metrics.NewCounter()
 	s.registry.Register("events.received", s.eventsRx)
 	s.registry.Register("events.bytes.received", s.bytesRx)
+	s.registry.Register("packets.rejected", s.packetsRejected)
 
 	return s
 }
 
 // Start instructs the UdpServer to start reading packets from the interface.
-func (s *UdpServer) Start(f func() chan<- string) error {
+func (s *UdpServer) Start(f func(*Event)) error {
 	conn, err := net.ListenUDP("udp", s.udpAddr)
 	if err != nil {
 		log.Println("failed to start UDP server", err)
 		return err
 	}
+	done := s.started(conn.LocalAddr(), conn)
 
 	go func() {
 		buf := make([]byte, msgBufSize)
 		for {
-			n, _, err := conn.ReadFromUDP(buf)
+			n, addr, err := conn.ReadFromUDP(buf)
 			if err != nil {
+				if stopped(done) {
+					return
+				}
 				log.Println("failed to read UDP", err)
+				continue
+			}
+			if !s.permits(addr.IP) {
+				s.packetsRejected.Inc(1)
+				continue
 			}
 			s.eventsRx.Inc(1)
 			s.bytesRx.Inc(int64(len(buf)))
-			f() <- strings.Trim(string(buf[:n]), "\r\n")
+			e := s.newEvent(strings.Trim(string(buf[:n]), "\r\n"), addr.String())
+			s.peers.Seen(e.Source, n, e.Received)
+			f(e)
 		}
 	}()
 	return nil
@@ -1,9 +1,21 @@
 package input
 
 import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
 	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
+	"time"
 
+	metrics "github.com/rcrowley/go-metrics"
 	. "gopkg.in/check.v1"
 )
 
@@ -23,15 +35,18 @@ var _ = Suite(&InputSuite{})
 func (s *InputSuite) Test_Simple(c *C) {
 	line := "<11>1 sshd is down\n<22>1 sshd is up\n<67>2 password accepted"
 	d := NewDelimiter(256)
-	ch := d.Stream(strings.NewReader(line))
+	ch := d.Stream(context.Background(), strings.NewReader(line), nil)
 	c.Assert(<-ch, Equals, "<11>1 sshd is down")
 	c.Assert(<-ch, Equals, "<22>1 sshd is up")
+	c.Assert(<-ch, Equals, "<67>2 password accepted")
+	_, ok := <-ch
+	c.Assert(ok, Equals, false)
 }
 
 func (s *InputSuite) Test_Leading(c *C) {
 	line := "password accepted for user root<12>1 sshd is down\n<145>1 sshd is up\n<67>2 password accepted"
 	d := NewDelimiter(256)
-	ch := d.Stream(strings.NewReader(line))
+	ch := d.Stream(context.Background(), strings.NewReader(line), nil)
 
 	c.Assert(<-ch, Equals, "<12>1 sshd is down")
 	c.Assert(<-ch, Equals, "<145>1 sshd is up")
@@ -40,7 +55,7 @@ func (s *InputSuite) Test_Leading(c *C) {
 func (s *InputSuite) Test_CRLF(c *C) {
 	line := "<12>1 sshd is down\r\n<145>1 sshd is up\r\n<67>2 password accepted"
 	d := NewDelimiter(256)
-	ch := d.Stream(strings.NewReader(line))
+	ch := d.Stream(context.Background(), strings.NewReader(line), nil)
 
 	c.Assert(<-ch, Equals, "<12>1 sshd is down")
 	c.Assert(<-ch, Equals, "<145>1 sshd is up")
@@ -49,7 +64,7 @@ func (s *InputSuite) Test_CRLF(c *C) {
 func (s *InputSuite) Test_Stacktrace(c *C) {
 	line := "<12>1 sshd is down\n<145>1 OOM on line 42, dummy.java\n\tclass_loader.jar\n<67>2 password accepted"
 	d := NewDelimiter(256)
-	ch := d.Stream(strings.NewReader(line))
+	ch := d.Stream(context.Background(), strings.NewReader(line), nil)
 
 	c.Assert(<-ch, Equals, "<12>1 sshd is down")
 	c.Assert(<-ch, Equals, "<145>1 OOM on line 42, dummy.java\n\tclass_loader.jar")
@@ -58,12 +73,80 @@ func (s *InputSuite) Test_Stacktrace(c *C) {
 func (s *InputSuite) Test_Embedded(c *C) {
 	line := "<12>1 sshd is <down>\n<145>1 sshd is up<33>4\n<67>2 password accepted"
 	d := NewDelimiter(256)
-	ch := d.Stream(strings.NewReader(line))
+	ch := d.Stream(context.Background(), strings.NewReader(line), nil)
 
 	c.Assert(<-ch, Equals, "<12>1 sshd is <down>")
 	c.Assert(<-ch, Equals, "<145>1 sshd is up<33>4")
 }
 
+func (s *InputSuite) Test_StreamError(c *C) {
+	line := "<11>1 sshd is down\n<22>1 sshd is up"
+	reader := bufio.NewReader(io.MultiReader(strings.NewReader(line), iotest.ErrReader(errors.New("broken pipe"))))
+	var streamErr error
+	d := NewDelimiter(256)
+	ch := d.Stream(context.Background(), reader, func(err error) { streamErr = err })
+
+	c.Assert(<-ch, Equals, "<11>1 sshd is down")
+	c.Assert(<-ch, Equals, "<22>1 sshd is up")
+	_, ok := <-ch
+	c.Assert(ok, Equals, false)
+	c.Assert(streamErr, ErrorMatches, "broken pipe")
+}
+
+func (s *InputSuite) Test_StreamCancel(c *C) {
+	line := strings.Repeat("<11>1 sshd is down\n", 100)
+	ctx, cancel := context.WithCancel(context.Background())
+	d := NewDelimiter(256)
+	ch := d.Stream(ctx, strings.NewReader(line), nil)
+
+	c.Assert(<-ch, Equals, "<11>1 sshd is down")
+	cancel()
+
+	// Nothing reads from the channel, yet it is closed promptly, without
+	// the message the Stream was emitting when cancelled.
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case _, ok := <-ch:
+		c.Assert(ok, Equals, false)
+	case <-time.After(5 * time.Second):
+		c.Fatal("channel not closed")
+	}
+}
+
+func (s *InputSuite) Test_StreamCancelError(c *C) {
+	// The reader fails once the context is cancelled, and the last
+	// message cannot be emitted since nothing reads it.
+	ctx, cancel := context.WithCancel(context.Background())
+	reader := &cancellingReader{r: strings.NewReader("<11>1 sshd is down"), cancel: cancel}
+	errs := make(chan error, 1)
+	d := NewDelimiter(256)
+	ch := d.Stream(ctx, reader, func(err error) { errs <- err })
+
+	select {
+	case err := <-errs:
+		c.Assert(err, ErrorMatches, "broken pipe")
+	case <-time.After(5 * time.Second):
+		c.Fatal("error not reported")
+	}
+	_, ok := <-ch
+	c.Assert(ok, Equals, false)
+}
+
+// A cancellingReader reads from r, and at its end calls cancel and fails.
+type cancellingReader struct {
+	r      *strings.Reader
+	cancel context.CancelFunc
+}
+
+func (r *cancellingReader) ReadByte() (byte, error) {
+	b, err := r.r.ReadByte()
+	if err != nil {
+		r.cancel()
+		return 0, errors.New("broken pipe")
+	}
+	return b, nil
+}
+
 func (s *InputSuite) Test_VestigeZero(c *C) {
 	d := NewDelimiter(256)
 	m, b := d.Vestige()
@@ -103,6 +186,143 @@ func (s *InputSuite) Test_VestigeRichMatch(c *C) {
 	c.Assert(m, Equals, line)
 }
 
+func (s *InputSuite) Test_DelimiterTransitions(c *C) {
+	// Each string in pushed is pushed a byte at a time, and the Delimiter
+	// then flushed with Vestige. Every message returned by either is
+	// expected in order.
+	tests := []struct {
+		name     string
+		pushed   []string
+		expected []string
+	}{
+		{"seeking, nothing", []string{""}, nil},
+		{"seeking, junk discarded", []string{"no header here\n"}, nil},
+		{"seeking, long junk discarded", []string{strings.Repeat("x", 1000)}, nil},
+		{"seeking, header found", []string{"<1>1 a"}, []string{"<1>1 a"}},
+		{"seeking, leading junk dropped", []string{"junk<34>1 a"}, []string{"<34>1 a"}},
+		{"seeking, header split by newline", []string{"junk\n<134>1 a"}, []string{"<134>1 a"}},
+		{"seeking, four digit priority", []string{"<1234>1 a"}, nil},
+		{"seeking, not a header", []string{"<12>x <>1 <a>1 a"}, nil},
+		{"seeking, header ending in newline", []string{"<12>1\na"}, []string{"<12>1\na"}},
+		{"in message, embedded header", []string{"<12>1 a <13>1 b"}, []string{"<12>1 a <13>1 b"}},
+		{"in message, continuation line", []string{"<12>1 a\n\tb\n"}, []string{"<12>1 a\n\tb"}},
+		{"in message, blank lines", []string{"<12>1 a\n\n"}, []string{"<12>1 a"}},
+		{"in message, header completes message", []string{"<12>1 a\n<13>1 b"}, []string{"<12>1 a", "<13>1 b"}},
+		{"in message, CRLF", []string{"<12>1 a\r\n<13>1 b\r\n"}, []string{"<12>1 a", "<13>1 b"}},
+		{"in message, header ending in newline", []string{"<12>1 a\n<13>1\nb"}, []string{"<12>1 a", "<13>1\nb"}},
+		{"in message, partial header", []string{"<12>1 a\n<13>"}, []string{"<12>1 a\n<13>"}},
+		{"in message, four digit priority", []string{"<12>1 a\n<1234>1 b"}, []string{"<12>1 a\n<1234>1 b"}},
+		{"flushed, seeks again", []string{"<12>1 a", "junk\n<13>1 b"}, []string{"<12>1 a", "<13>1 b"}},
+		{"flushed, partial header kept", []string{"<12", ">1 a"}, []string{"<12>1 a"}},
+		{"flushed, partial header after junk kept", []string{"junk<1", "2>1 a"}, []string{"<12>1 a"}},
+		{"flushed, partial header and version kept", []string{"<12>1", " a"}, []string{"<12>1 a"}},
+		{"flushed, not a partial header", []string{"<12x", ">1 a"}, nil},
+		{"flushed, four digits not a partial header", []string{"<1234", ">1 a"}, nil},
+		{"flushed, junk then message", []string{"junk", "more junk\n<12>1 a\n<13>1 b"}, []string{"<12>1 a", "<13>1 b"}},
+		{"flushed twice", []string{"<12>1 a", ""}, []string{"<12>1 a"}},
+	}
+
+	for _, tt := range tests {
+		d := NewDelimiter(8)
+		var out []string
+		for _, p := range tt.pushed {
+			for i := 0; i < len(p); i++ {
+				if m, ok := d.Push(p[i]); ok {
+					out = append(out, m)
+				}
+			}
+			if m, ok := d.Vestige(); ok {
+				out = append(out, m)
+			}
+		}
+		c.Check(out, DeepEquals, tt.expected, Commentf(tt.name))
+	}
+}
+
+/*
+ * Multiline tests.
+ */
+
+func (s *InputSuite) Test_JoinerDisabled(c *C) {
+	j := newJoiner(Multiline{}, metrics.NewCounter())
+	m, ok := j.push("<134>1 - host app 1 - first")
+	c.Assert(ok, Equals, true)
+	c.Assert(m, Equals, "<134>1 - host app 1 - first")
+	_, ok = j.flush()
+	c.Assert(ok, Equals, false)
+}
+
+func (s *InputSuite) Test_JoinerMaxLines(c *C) {
+	merged := metrics.NewCounter()
+	j := newJoiner(Multiline{Whitespace: true, MaxLines: 2}, merged)
+
+	var out []string
+	for _, l := range []string{
+		"<131>1 - host app 1 - boom",
+		"<131>1 - host app 1 -  at a",
+		"<131>1 - host app 1 -  at b",
+		"<131>1 - host app 1 -  at c",
+	} {
+		if m, ok := j.push(l); ok {
+			out = append(out, m)
+		}
+	}
+	if m, ok := j.flush(); ok {
+		out = append(out, m)
+	}
+
+	c.Assert(out, DeepEquals, []string{
+		"<131>1 - host app 1 - boom\n at a",
+		"<131>1 - host app 1 -  at b\n at c",
+	})
+	c.Assert(merged.Count(), Equals, int64(2))
+}
+
+func (s *InputSuite) Test_SplitHeader(c *C) {
+	host, app, msg, ok := splitHeader("<131>1 2013-09-04T10:25:52Z host app 1 - \tat Main.main")
+	c.Assert(ok, Equals, true)
+	c.Assert([]string{host, app, msg}, DeepEquals, []string{"host", "app", "\tat Main.main"})
+
+	for _, raw := range []string{"<131>1 - host app 1", "<131>1 - host  app 1 - x", "<131>", "no header"} {
+		_, _, _, ok = splitHeader(raw)
+		c.Assert(ok, Equals, false, Commentf(raw))
+	}
+}
+
+func (s *InputSuite) Test_JoinerContinuation(c *C) {
+	merged := metrics.NewCounter()
+	j := newJoiner(Multiline{
+		Whitespace: true,
+		Prefixes:   []string{"Caused by:"},
+		Patterns:   []*regexp.Regexp{regexp.MustCompile(`^\.\.\. \d+ more$`)},
+	}, merged)
+
+	lines := []string{
+		"<131>1 - host app 1 - java.lang.RuntimeException: boom",
+		"<131>1 - host app 1 - \tat Main.main(Main.java:3)",
+		"<131>1 - host app 1 - Caused by: java.io.IOException",
+		"<131>1 - host app 1 - ... 2 more",
+		"<131>1 - other app 1 - \tat Other.run(Other.java:9)",
+		"<134>1 - host app 1 - done",
+	}
+	var out []string
+	for _, l := range lines {
+		if m, ok := j.push(l); ok {
+			out = append(out, m)
+		}
+	}
+	if m, ok := j.flush(); ok {
+		out = append(out, m)
+	}
+
+	c.Assert(out, DeepEquals, []string{
+		"<131>1 - host app 1 - java.lang.RuntimeException: boom\n\tat Main.main(Main.java:3)\nCaused by: java.io.IOException\n... 2 more",
+		"<131>1 - other app 1 - \tat Other.run(Other.java:9)",
+		"<134>1 - host app 1 - done",
+	})
+	c.Assert(merged.Count(), Equals, int64(3))
+}
+
 /*
  * Rfc5424 parser tests
  */
@@ -110,57 +330,654 @@ func (s *InputSuite) Test_VestigeRichMatch(c *C) {
 func (s *InputSuite) Test_SuccessfulParsing(c *C) {
 	p := NewRfc5424Parser()
 
-	m := p.Parse("<134>1 2013-09-04T10:25:52.618085 ubuntu sshd 1999 - password accepted")
-	e := ParsedMessage{Priority: 134, Version: 1, Timestamp: "2013-09-04T10:25:52.618085", Host: "ubuntu", App: "sshd", Pid: 1999, MsgId: "-", Message: "password accepted"}
+	m, _ := p.Parse("<134>1 2013-09-04T10:25:52.618085 ubuntu sshd 1999 - password accepted")
+	e := ParsedMessage{Priority: 134, Facility: 16, FacilityName: "local0", Severity: 6, SeverityName: "info", Version: 1, Timestamp: "2013-09-04T10:25:52.618085Z", Time: time.Date(2013, 9, 4, 10, 25, 52, 618085000, time.UTC), Host: "ubuntu", App: "sshd", Pid: 1999, MsgId: "-", Message: "password accepted"}
 	c.Assert(*m, Equals, e)
 
-	m = p.Parse("<33>5 2013-09-04T10:25:52.618085 test.com cron 304 - password accepted")
-	e = ParsedMessage{Priority: 33, Version: 5, Timestamp: "2013-09-04T10:25:52.618085", Host: "test.com", App: "cron", Pid: 304, MsgId: "-", Message: "password accepted"}
+	m, _ = p.Parse("<33>5 2013-09-04T10:25:52.618085 test.com cron 304 - password accepted")
+	e = ParsedMessage{Priority: 33, Facility: 4, FacilityName: "auth", Severity: 1, SeverityName: "alert", Version: 5, Timestamp: "2013-09-04T10:25:52.618085Z", Time: time.Date(2013, 9, 4, 10, 25, 52, 618085000, time.UTC), Host: "test.com", App: "cron", Pid: 304, MsgId: "-", Message: "password accepted"}
 	c.Assert(*m, Equals, e)
 
-	m = p.Parse("<1>0 2013-09-04T10:25:52.618085 test.com cron 65535 - password accepted")
-	e = ParsedMessage{Priority: 1, Version: 0, Timestamp: "2013-09-04T10:25:52.618085", Host: "test.com", App: "cron", Pid: 65535, MsgId: "-", Message: "password accepted"}
+	m, _ = p.Parse("<1>0 2013-09-04T10:25:52.618085 test.com cron 65535 - password accepted")
+	e = ParsedMessage{Priority: 1, Facility: 0, FacilityName: "kern", Severity: 1, SeverityName: "alert", Version: 0, Timestamp: "2013-09-04T10:25:52.618085Z", Time: time.Date(2013, 9, 4, 10, 25, 52, 618085000, time.UTC), Host: "test.com", App: "cron", Pid: 65535, MsgId: "-", Message: "password accepted"}
 	c.Assert(*m, Equals, e)
 
-	m = p.Parse("<1>0 2013-09-04T10:25:52.618085 test.com cron 65535 msgid1234 password accepted")
-	e = ParsedMessage{Priority: 1, Version: 0, Timestamp: "2013-09-04T10:25:52.618085", Host: "test.com", App: "cron", Pid: 65535, MsgId: "msgid1234", Message: "password accepted"}
+	m, _ = p.Parse("<1>0 2013-09-04T10:25:52.618085 test.com cron 65535 msgid1234 password accepted")
+	e = ParsedMessage{Priority: 1, Facility: 0, FacilityName: "kern", Severity: 1, SeverityName: "alert", Version: 0, Timestamp: "2013-09-04T10:25:52.618085Z", Time: time.Date(2013, 9, 4, 10, 25, 52, 618085000, time.UTC), Host: "test.com", App: "cron", Pid: 65535, MsgId: "msgid1234", Message: "password accepted"}
 	c.Assert(*m, Equals, e)
 
-	m = p.Parse("<1>0 2013-09-04T10:25:52.618085 test.com cron 65535 - JVM NPE\nsome_file.java:48\n\tsome_other_file.java:902")
-	e = ParsedMessage{Priority: 1, Version: 0, Timestamp: "2013-09-04T10:25:52.618085", Host: "test.com", App: "cron", Pid: 65535, MsgId: "-", Message: "JVM NPE\nsome_file.java:48\n\tsome_other_file.java:902"}
+	m, _ = p.Parse("<1>0 2013-09-04T10:25:52.618085 test.com cron 65535 - JVM NPE\nsome_file.java:48\n\tsome_other_file.java:902")
+	e = ParsedMessage{Priority: 1, Facility: 0, FacilityName: "kern", Severity: 1, SeverityName: "alert", Version: 0, Timestamp: "2013-09-04T10:25:52.618085Z", Time: time.Date(2013, 9, 4, 10, 25, 52, 618085000, time.UTC), Host: "test.com", App: "cron", Pid: 65535, MsgId: "-", Message: "JVM NPE\nsome_file.java:48\n\tsome_other_file.java:902"}
 	c.Assert(*m, Equals, e)
 
-	m = p.Parse("<27>1 2015-03-02T22:53:45-08:00 localhost.localdomain puppet-agent 5334 - mirrorurls.extend(list(self.metalink_data.urls()))")
-	e = ParsedMessage{Priority: 27, Version: 1, Timestamp: "2015-03-02T22:53:45-08:00", Host: "localhost.localdomain", App: "puppet-agent", Pid: 5334, MsgId: "-", Message: "mirrorurls.extend(list(self.metalink_data.urls()))"}
+	m, _ = p.Parse("<27>1 2015-03-02T22:53:45-08:00 localhost.localdomain puppet-agent 5334 - mirrorurls.extend(list(self.metalink_data.urls()))")
+	e = ParsedMessage{Priority: 27, Facility: 3, FacilityName: "daemon", Severity: 3, SeverityName: "err", Version: 1, Timestamp: "2015-03-03T06:53:45Z", Time: time.Date(2015, 3, 3, 6, 53, 45, 0, time.UTC), Host: "localhost.localdomain", App: "puppet-agent", Pid: 5334, MsgId: "-", Message: "mirrorurls.extend(list(self.metalink_data.urls()))"}
 	c.Assert(*m, Equals, e)
 
-	m = p.Parse("<29>1 2015-03-03T06:49:08-08:00 localhost.localdomain puppet-agent 51564 - (/Stage[main]/Users_prd/Ssh_authorized_key[1063-username]) Dependency Group[group] has failures: true")
-	e = ParsedMessage{Priority: 29, Version: 1, Timestamp: "2015-03-03T06:49:08-08:00", Host: "localhost.localdomain", App: "puppet-agent", Pid: 51564, MsgId: "-", Message: "(/Stage[main]/Users_prd/Ssh_authorized_key[1063-username]) Dependency Group[group] has failures: true"}
+	m, _ = p.Parse("<29>1 2015-03-03T06:49:08-08:00 localhost.localdomain puppet-agent 51564 - (/Stage[main]/Users_prd/Ssh_authorized_key[1063-username]) Dependency Group[group] has failures: true")
+	e = ParsedMessage{Priority: 29, Facility: 3, FacilityName: "daemon", Severity: 5, SeverityName: "notice", Version: 1, Timestamp: "2015-03-03T14:49:08Z", Time: time.Date(2015, 3, 3, 14, 49, 8, 0, time.UTC), Host: "localhost.localdomain", App: "puppet-agent", Pid: 51564, MsgId: "-", Message: "(/Stage[main]/Users_prd/Ssh_authorized_key[1063-username]) Dependency Group[group] has failures: true"}
 	c.Assert(*m, Equals, e)
 
-	m = p.Parse("<142>1 2015-03-02T22:23:07-08:00 localhost.localdomain Keepalived_vrrp 21125 - VRRP_Instance(VI_1) ignoring received advertisement...")
-	e = ParsedMessage{Priority: 142, Version: 1, Timestamp: "2015-03-02T22:23:07-08:00", Host: "localhost.localdomain", App: "Keepalived_vrrp", Pid: 21125, MsgId: "-", Message: "VRRP_Instance(VI_1) ignoring received advertisement..."}
+	m, _ = p.Parse("<142>1 2015-03-02T22:23:07-08:00 localhost.localdomain Keepalived_vrrp 21125 - VRRP_Instance(VI_1) ignoring received advertisement...")
+	e = ParsedMessage{Priority: 142, Facility: 17, FacilityName: "local1", Severity: 6, SeverityName: "info", Version: 1, Timestamp: "2015-03-03T06:23:07Z", Time: time.Date(2015, 3, 3, 6, 23, 7, 0, time.UTC), Host: "localhost.localdomain", App: "Keepalived_vrrp", Pid: 21125, MsgId: "-", Message: "VRRP_Instance(VI_1) ignoring received advertisement..."}
 	c.Assert(*m, Equals, e)
 }
 
+func (s *InputSuite) Test_LeadingJunk(c *C) {
+	p := NewRfc5424Parser()
+	e := ParsedMessage{Priority: 134, Facility: 16, FacilityName: "local0", Severity: 6, SeverityName: "info", Version: 1, Timestamp: "2013-09-04T10:25:52.618085Z", Time: time.Date(2013, 9, 4, 10, 25, 52, 618085000, time.UTC), Host: "ubuntu", App: "sshd", Pid: 1999, MsgId: "-", Message: "password accepted"}
+	for _, junk := range []string{"", "junk", "x<y ", "<<", "<1234>1 ", "<12>x <1>", "<13>1"} {
+		m, err := p.Parse(junk + "<134>1 2013-09-04T10:25:52.618085Z ubuntu sshd 1999 - password accepted")
+		c.Assert(err, IsNil, Commentf(junk))
+		c.Assert(*m, Equals, e, Commentf(junk))
+	}
+}
+
+func (s *InputSuite) Test_NilValues(c *C) {
+	received := time.Date(2015, 3, 4, 10, 25, 52, 0, time.UTC)
+	m, err := NewRfc5424Parser().parseAt("<134>1 - - - - - password accepted", received)
+	c.Assert(err, IsNil)
+	e := ParsedMessage{Priority: 134, Facility: 16, FacilityName: "local0", Severity: 6, SeverityName: "info", Version: 1, Timestamp: "2015-03-04T10:25:52Z", Time: received, Host: "-", App: "-", MsgId: "-", Message: "password accepted"}
+	c.Assert(*m, Equals, e)
+}
+
+func (s *InputSuite) Test_PriorityNames(c *C) {
+	m, err := NewRfc5424Parser().Parse("<86>1 2013-09-04T10:25:52.618085 ubuntu sshd 1999 - password accepted")
+	c.Assert(err, IsNil)
+	c.Assert(m.Facility, Equals, 10)
+	c.Assert(m.FacilityName, Equals, "authpriv")
+	c.Assert(m.Severity, Equals, 6)
+	c.Assert(m.SeverityName, Equals, "info")
+
+	c.Assert(FacilityName(23), Equals, "local7")
+	c.Assert(FacilityName(24), Equals, "24")
+	c.Assert(SeverityName(3), Equals, "err")
+}
+
+func (s *InputSuite) Test_ParseTimestamp(c *C) {
+	p := NewRfc5424Parser()
+	p.SetTimestamp("2006-01-02 15:04:05", time.Hour)
+	received := time.Date(2015, 3, 3, 7, 0, 0, 0, time.UTC)
+
+	m, err := p.parseAt("<134>1 2015-03-02T22:53:45-08:00 ubuntu sshd 1999 - password accepted", received)
+	c.Assert(err, IsNil)
+	c.Assert(m.Timestamp, Equals, "2015-03-03 06:53:45")
+	c.Assert(m.Time, Equals, time.Date(2015, 3, 3, 6, 53, 45, 0, time.UTC))
+	c.Assert(p.skewed.Count(), Equals, int64(0))
+
+	m, err = p.parseAt("<134>1 - ubuntu sshd 1999 - password accepted", received)
+	c.Assert(err, IsNil)
+	c.Assert(m.Timestamp, Equals, "2015-03-03 07:00:00")
+	c.Assert(p.skewed.Count(), Equals, int64(0))
+
+	_, err = p.parseAt("<134>1 2015-03-03T09:00:00+01:00 ubuntu sshd 1999 - password accepted", received)
+	c.Assert(err, IsNil)
+	_, err = p.parseAt("<134>1 2015-03-03T09:00:00.5Z ubuntu sshd 1999 - password accepted", received)
+	c.Assert(err, IsNil)
+	c.Assert(p.skewed.Count(), Equals, int64(1))
+}
+
+func (s *InputSuite) Test_ParseTimestampZone(c *C) {
+	raw := "<134>1 2013-09-04T10:25:52.618085 ubuntu sshd 1999 - password accepted"
+	utc := time.Date(2013, 9, 4, 10, 25, 52, 618085000, time.UTC)
+
+	// By default a timestamp without a time zone is taken to be UTC.
+	p := NewRfc5424Parser()
+	m, err := p.Parse(raw)
+	c.Assert(err, IsNil)
+	c.Assert(m.Time, Equals, utc)
+	c.Assert(m.Lenient, Equals, false)
+
+	p.SetRequireZone(true)
+	_, err = p.Parse(raw)
+	c.Assert(err, ErrorMatches, "timestamp: no time zone")
+	c.Assert(err.(*ParseError).Code, Equals, CodeInvalid)
+
+	// In lenient mode it is still accepted, but the message is marked.
+	p.SetLenient(true)
+	m, err = p.Parse(raw)
+	c.Assert(err, IsNil)
+	c.Assert(m.Time, Equals, utc)
+	c.Assert(m.Lenient, Equals, true)
+}
+
 func (s *InputSuite) Test_FailedParsing(c *C) {
 	p := NewRfc5424Parser()
 
-	m := p.Parse("<134> 2013-09-04T10:25:52.618085 ubuntu sshd 1999 - password accepted")
-	c.Assert(m, IsNil)
+	tests := []struct {
+		raw   string
+		field string
+		code  string
+	}{
+		{"<134> 2013-09-04T10:25:52.618085 ubuntu sshd 1999 - password accepted", FieldVersion, CodeInvalid},
+		{"<33> 7 2013-09-04T10:25:52.618085 test.com cron 304 - password accepted", FieldVersion, CodeInvalid},
+		{"<33> 7 2013-09-04T10:25:52.618085 test.com cron 304 $ password accepted", FieldVersion, CodeInvalid},
+		{"<33> 7 2013-09-04T10:25:52.618085 test.com cron 304 - - password accepted", FieldVersion, CodeInvalid},
+		{"<33>7 2013-09-04T10:25:52.618085 test.com cron not_a_pid - password accepted", FieldPid, CodeInvalid},
+		{"5:52.618085 test.com cron 65535 - password accepted", FieldPriority, CodeMissing},
+		{"<192>1 2013-09-04T10:25:52.618085 test.com cron 304 - password accepted", FieldPriority, CodeOutOfRange},
+		{"<1234>1 2013-09-04T10:25:52.618085 test.com cron 304 - password accepted", FieldPriority, CodeInvalid},
+		{"<33>12 2013-09-04T10:25:52.618085 test.com cron 304 - password accepted", FieldVersion, CodeInvalid},
+		{"<33>1  test.com cron 304 - password accepted", FieldTimestamp, CodeMissing},
+		{"<33>1 Sep-4 test.com cron 304 - password accepted", FieldTimestamp, CodeInvalid},
+		{"<33>1 2013-09-04T10:25:52.618085 test.com cron", FieldPid, CodeMissing},
+		{"<33>1 2013-09-04T10:25:52.618085 test.com cron 123456 - password accepted", FieldPid, CodeInvalid},
+		{"<33>1 2013-09-04T10:25:52.618085 test.com cron 304 $ password accepted", FieldMsgId, CodeInvalid},
+		{"<33>1 2013-09-04T10:25:52.618085 test.com cron 304 -", FieldMessage, CodeMissing},
+	}
+	for _, t := range tests {
+		m, err := p.Parse(t.raw)
+		c.Assert(m, IsNil)
+		c.Assert(err, FitsTypeOf, &ParseError{})
+		c.Assert(err.(*ParseError).Field, Equals, t.field, Commentf(t.raw))
+		c.Assert(err.(*ParseError).Code, Equals, t.code, Commentf(t.raw))
+	}
+	c.Assert(p.dropped.Count(), Equals, int64(len(tests)))
+
+	// Each field and code is counted separately.
+	for key, n := range map[string]int64{
+		"version.invalid": 5, "pid.invalid": 2, "pid.missing": 1, "timestamp.invalid": 1, "timestamp.missing": 1,
+		"priority.missing": 1, "priority.invalid": 1, "priority.out_of_range": 1, "msgid.invalid": 1, "message.missing": 1,
+		"host.missing": 0,
+	} {
+		c.Assert(p.droppedBy[key].Count(), Equals, n, Commentf(key))
+		c.Assert(p.registry.Get("events.dropped."+key), Equals, p.droppedBy[key], Commentf(key))
+	}
+}
 
-	m = p.Parse("<33> 7 2013-09-04T10:25:52.618085 test.com cron 304 - password accepted")
-	c.Assert(m, IsNil)
+func (s *InputSuite) Test_LenientParsing(c *C) {
+	p := NewRfc5424Parser()
+	p.SetLenient(true)
+	received := time.Date(2015, 3, 4, 10, 25, 52, 0, time.UTC)
+
+	tests := []struct {
+		raw      string
+		expected ParsedMessage
+	}{
+		{"<134>1 2013-09-04T10:25:52.618085 ubuntu sshd 1999 - password accepted",
+			ParsedMessage{Priority: 134, Facility: 16, FacilityName: "local0", Severity: 6, SeverityName: "info", Version: 1, Timestamp: "2013-09-04T10:25:52.618085Z", Time: time.Date(2013, 9, 4, 10, 25, 52, 618085000, time.UTC), Host: "ubuntu", App: "sshd", Pid: 1999, MsgId: "-", Message: "password accepted", ProcId: "1999"}},
+		{"<134>1 - - - - - password accepted",
+			ParsedMessage{Priority: 134, Facility: 16, FacilityName: "local0", Severity: 6, SeverityName: "info", Version: 1, Timestamp: "2015-03-04T10:25:52Z", Time: received, Host: "-", App: "-", MsgId: "-", Message: "password accepted", ProcId: "-"}},
+		{"<134>1 2013-09-04T10:25:52.618085 ubuntu sshd worker-3 - password accepted",
+			ParsedMessage{Priority: 134, Facility: 16, FacilityName: "local0", Severity: 6, SeverityName: "info", Version: 1, Timestamp: "2013-09-04T10:25:52.618085Z", Time: time.Date(2013, 9, 4, 10, 25, 52, 618085000, time.UTC), Host: "ubuntu", App: "sshd", MsgId: "-", Message: "password accepted", ProcId: "worker-3", Lenient: true}},
+		{"<134>- 2013-09-04T10:25:52.618085 ubuntu sshd 1999 - password accepted",
+			ParsedMessage{Priority: 134, Facility: 16, FacilityName: "local0", Severity: 6, SeverityName: "info", Timestamp: "2013-09-04T10:25:52.618085Z", Time: time.Date(2013, 9, 4, 10, 25, 52, 618085000, time.UTC), Host: "ubuntu", App: "sshd", Pid: 1999, MsgId: "-", Message: "password accepted", ProcId: "1999", Lenient: true}},
+		{"<134>Sep  4 10:25:52 ubuntu sshd[1999]: password accepted",
+			ParsedMessage{Priority: 134, Facility: 16, FacilityName: "local0", Severity: 6, SeverityName: "info", Timestamp: "2015-03-04T10:25:52Z", Time: received, Message: "Sep  4 10:25:52 ubuntu sshd[1999]: password accepted", Lenient: true}},
+		{"<134>1 2013-09-04T10:25:52.618085 ubuntu sshd 1999 $ password accepted",
+			ParsedMessage{Priority: 134, Facility: 16, FacilityName: "local0", Severity: 6, SeverityName: "info", Version: 1, Timestamp: "2013-09-04T10:25:52.618085Z", Time: time.Date(2013, 9, 4, 10, 25, 52, 618085000, time.UTC), Host: "ubuntu", App: "sshd", Pid: 1999, Message: "$ password accepted", ProcId: "1999", Lenient: true}},
+		{"<134>1 2013-09-04T10:25:52.618085 ubuntu",
+			ParsedMessage{Priority: 134, Facility: 16, FacilityName: "local0", Severity: 6, SeverityName: "info", Version: 1, Timestamp: "2013-09-04T10:25:52.618085Z", Time: time.Date(2013, 9, 4, 10, 25, 52, 618085000, time.UTC), Host: "ubuntu", Lenient: true}},
+	}
+	for _, t := range tests {
+		m, err := p.parseAt(t.raw, received)
+		c.Assert(err, IsNil, Commentf(t.raw))
+		c.Assert(*m, Equals, t.expected, Commentf(t.raw))
+	}
+	c.Assert(p.parsed.Count(), Equals, int64(len(tests)))
+	c.Assert(p.parsedLax.Count(), Equals, int64(len(tests)-2))
 
-	m = p.Parse("<33> 7 2013-09-04T10:25:52.618085 test.com cron 304 $ password accepted")
-	c.Assert(m, IsNil)
+	// The PRI is still required.
+	_, err := p.Parse("password accepted")
+	c.Assert(err, ErrorMatches, "priority: missing")
+}
 
-	m = p.Parse("<33> 7 2013-09-04T10:25:52.618085 test.com cron 304 - - password accepted")
-	c.Assert(m, IsNil)
+func (s *InputSuite) Test_Failures(c *C) {
+	f := NewFailures(3)
+	c.Assert(f.Recent(), HasLen, 0)
+	for _, r := range []string{"a", "b", "c", "d"} {
+		f.Add(&DeadLetter{Raw: r})
+	}
+	recent := f.Recent()
+	c.Assert(recent, HasLen, 3)
+	c.Assert(recent[0].Raw, Equals, "b")
+	c.Assert(recent[2].Raw, Equals, "d")
+}
 
-	m = p.Parse("<33>7 2013-09-04T10:25:52.618085 test.com cron not_a_pid - password accepted")
-	c.Assert(m, IsNil)
+func (s *InputSuite) Test_StreamingParse(c *C) {
+	p := NewRfc5424Parser()
+	in := make(chan *Event)
+	out := make(chan *Event)
+	done := p.StreamingParse(in, 4, false, func(e *Event) { out <- e })
+
+	go func() {
+		in <- NewEvent("<134>1 2013-09-04T10:25:52.618085 ubuntu sshd 1999 - password accepted", "10.0.0.1:514")
+		in <- NewEvent("not syslog", "10.0.0.1:514")
+		in <- NewEvent("<33>5 2013-09-04T10:25:52.618085 test.com cron 304 - password accepted", "10.0.0.2:514")
+		close(in)
+	}()
+	apps := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		e := <-out
+		c.Assert(e.Parsed, NotNil)
+		apps[e.Parsed.App] = true
+	}
+	c.Assert(apps, DeepEquals, map[string]bool{"sshd": true, "cron": true})
+	<-done
+}
 
-	m = p.Parse("5:52.618085 test.com cron 65535 - password accepted")
-	c.Assert(m, IsNil)
+func (s *InputSuite) Test_StreamingParseDeadLetter(c *C) {
+	p := NewRfc5424Parser()
+	in := make(chan *Event)
+	dead := make(chan *DeadLetter)
+	p.SetDeadLetter(func(e *Event, reason string) { dead <- NewDeadLetter(e, reason) })
+	done := p.StreamingParse(in, 1, false, func(e *Event) {})
+
+	e := NewEvent("not syslog", "10.0.0.1:514")
+	in <- e
+	close(in)
+	d := <-dead
+	<-done
+	c.Assert(d.Raw, Equals, "not syslog")
+	c.Assert(d.Source, Equals, "10.0.0.1:514")
+	c.Assert(d.Received, Equals, e.Received)
+	c.Assert(d.Reason, Equals, "priority: missing")
+	c.Assert(p.deadLettered.Count(), Equals, int64(1))
+	c.Assert(p.Failures().Recent(), HasLen, 1)
+}
+
+func (s *InputSuite) Test_StreamingParseMetadata(c *C) {
+	p := NewRfc5424Parser()
+	p.SetMetadata(true)
+	in := make(chan *Event)
+	out := make(chan *Event)
+	done := p.StreamingParse(in, 1, false, func(e *Event) { out <- e })
+
+	e := NewEvent("<134>1 2013-09-04T10:25:52.618085Z ubuntu sshd 1999 - password accepted", "10.0.0.1:41234")
+	e.Received = time.Date(2015, 3, 4, 10, 25, 52, 0, time.UTC)
+	e.Listener, e.Protocol = "0.0.0.0:514", "tcp"
+	in <- e
+	close(in)
+
+	hostname, _ := os.Hostname()
+	meta := (<-out).Parsed.Meta
+	<-done
+	c.Assert(meta, NotNil)
+	c.Assert(*meta, Equals, Metadata{Received: "2015-03-04T10:25:52Z", PeerIP: "10.0.0.1", PeerPort: 41234,
+		Listener: "0.0.0.0:514", Protocol: "tcp", Collector: hostname})
+}
+
+func (s *InputSuite) Test_StreamingParseOrdered(c *C) {
+	p := NewRfc5424Parser()
+	in := make(chan *Event)
+	out := make(chan *Event)
+	done := p.StreamingParse(in, 4, true, func(e *Event) { out <- e })
+
+	sources := []string{"10.0.0.1:514", "10.0.0.2:514", "10.0.0.3:514", "10.0.0.4:514"}
+	n := 100
+	go func() {
+		for i := 0; i < n; i++ {
+			for _, src := range sources {
+				in <- NewEvent(fmt.Sprintf("<134>1 2013-09-04T10:25:52.618085 ubuntu sshd %d - seq", i), src)
+			}
+		}
+		close(in)
+	}()
+
+	next := map[string]int{}
+	for i := 0; i < n*len(sources); i++ {
+		e := <-out
+		c.Assert(e.Parsed.Pid, Equals, next[e.Source])
+		next[e.Source]++
+	}
+	<-done
+}
+
+/*
+ * Peer tracking and silence monitor tests
+ */
+
+func (s *InputSuite) Test_PeerTracker(c *C) {
+	t := NewPeerTracker()
+	now := time.Now()
+	t.Seen("10.0.0.2:514", 10, now)
+	t.Seen("10.0.0.1:3000", 5, now)
+	t.Seen("10.0.0.1:3001", 7, now.Add(time.Second))
+
+	peers := t.Peers()
+	c.Assert(peers, HasLen, 2)
+	c.Assert(peers[0].Host, Equals, "10.0.0.1")
+	c.Assert(peers[0].Events, Equals, int64(2))
+	c.Assert(peers[0].Bytes, Equals, int64(12))
+	c.Assert(peers[0].FirstSeen, Equals, now)
+	c.Assert(peers[0].LastSeen, Equals, now.Add(time.Second))
+	c.Assert(peers[1].Host, Equals, "10.0.0.2")
+}
+
+func (s *InputSuite) Test_PeerTrackerBounded(c *C) {
+	t := NewPeerTracker()
+	t.max = 8
+	now := time.Now()
+	for i := 0; i < 8; i++ {
+		t.Seen(fmt.Sprintf("10.0.0.%d:514", i), 1, now.Add(time.Duration(i)*time.Second))
+	}
+	c.Assert(t.Peers(), HasLen, 8)
+
+	// The hosts seen least recently make room for a new one.
+	t.Seen("10.0.1.1:514", 1, now.Add(time.Minute))
+	peers := t.Peers()
+	c.Assert(peers, HasLen, 6)
+	c.Assert(peers[0].Host, Equals, "10.0.0.3")
+	c.Assert(peers[5].Host, Equals, "10.0.1.1")
+
+	c.Assert(t.Expire(now.Add(6*time.Second)), Equals, 3)
+	c.Assert(t.Peers(), HasLen, 3)
+}
+
+func (s *InputSuite) Test_SilenceMonitor(c *C) {
+	tcp := NewPeerTracker()
+	udp := NewPeerTracker()
+	now := time.Now()
+	tcp.Seen("10.0.0.1:3000", 10, now)
+	udp.Seen("10.0.0.1:514", 10, now)
+	udp.Seen("10.0.0.2:514", 10, now)
+
+	m := NewSilenceMonitor(time.Minute, 2, tcp, udp)
+	c.Assert(m.Check(now.Add(time.Second)), HasLen, 0)
+
+	// Only the host which has sent enough events is alerted, and only once.
+	raised := m.Check(now.Add(2 * time.Minute))
+	c.Assert(raised, HasLen, 1)
+	c.Assert(raised[0].Host, Equals, "10.0.0.1")
+	c.Assert(raised[0].Events, Equals, int64(2))
+	c.Assert(m.Check(now.Add(3*time.Minute)), HasLen, 0)
+	c.Assert(m.Alerts(), HasLen, 1)
+
+	// The alert clears once the host sends again.
+	udp.Seen("10.0.0.1:514", 10, now.Add(4*time.Minute))
+	c.Assert(m.Check(now.Add(4*time.Minute)), HasLen, 0)
+	c.Assert(m.Alerts(), HasLen, 0)
+
+	// Hosts silent for long enough are forgotten, along with their alerts.
+	c.Assert(m.Check(now.Add(6*time.Minute)), HasLen, 1)
+	c.Assert(m.Check(now.Add(15*time.Minute)), HasLen, 0)
+	c.Assert(m.Alerts(), HasLen, 0)
+	c.Assert(tcp.Peers(), HasLen, 0)
+	c.Assert(udp.Peers(), HasLen, 0)
+}
+
+func (s *InputSuite) Test_SilenceEvent(c *C) {
+	m := NewSilenceMonitor(time.Minute, 0)
+	now := time.Now()
+	e := NewSyntheticEvent(now, m.message(Alert{Host: "10.0.0.1", LastSeen: now.Add(-2 * time.Minute), Raised: now})).Raw
+
+	c.Assert(strings.HasPrefix(e, "<44>1 "+now.Format(time.RFC3339)+" "), Equals, true)
+	c.Assert(strings.HasSuffix(e, " - host 10.0.0.1 silent for 2m0s, last seen "+now.Add(-2*time.Minute).Format(time.RFC3339)), Equals, true)
+
+	p, err := NewRfc5424Parser().Parse(e)
+	c.Assert(err, IsNil)
+	c.Assert(p.App, Equals, "syslog-gollector")
+	c.Assert(p.SeverityName, Equals, "warning")
+}
+
+/*
+ * ACL tests
+ */
+
+func mustCIDRs(c *C, cidrs ...string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		c.Assert(err, IsNil)
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+func (s *InputSuite) Test_ACL(c *C) {
+	var none *ACL
+	c.Assert(none.Permits(net.ParseIP("10.0.0.1")), Equals, true)
+
+	a := NewACL(nil, mustCIDRs(c, "10.0.0.0/24"))
+	c.Assert(a.Permits(net.ParseIP("10.0.0.1")), Equals, false)
+	c.Assert(a.Permits(net.ParseIP("10.0.1.1")), Equals, true)
+
+	a = NewACL(mustCIDRs(c, "10.0.0.0/8", "fd00::/8"), mustCIDRs(c, "10.0.0.0/24"))
+	c.Assert(a.Permits(net.ParseIP("10.0.0.1")), Equals, false)
+	c.Assert(a.Permits(net.ParseIP("10.0.1.1")), Equals, true)
+	c.Assert(a.Permits(net.ParseIP("fd00::1")), Equals, true)
+	c.Assert(a.Permits(net.ParseIP("192.168.0.1")), Equals, false)
+}
+
+func (s *InputSuite) Test_TcpServerACL(c *C) {
+	t := NewTcpServer("127.0.0.1:0")
+	t.SetACL(NewACL(nil, mustCIDRs(c, "127.0.0.0/8")))
+	events := make(chan *Event, 1)
+	c.Assert(t.Start(func(e *Event) { events <- e }), IsNil)
+	defer t.Stop()
+
+	conn, err := net.Dial("tcp", t.Addr().String())
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	// The connection is closed by the server.
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	c.Assert(err, NotNil)
+	c.Assert(t.connectionsRejected.Count(), Equals, int64(1))
+
+	t.SetACL(nil)
+	conn, err = net.Dial("tcp", t.Addr().String())
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	_, err = conn.Write([]byte("<134>1 - - - - - hello\n"))
+	c.Assert(err, IsNil)
+	select {
+	case e := <-events:
+		c.Assert(e.Protocol, Equals, "tcp")
+	case <-time.After(5 * time.Second):
+		c.Fatal("event not received")
+	}
+}
+
+// closed returns whether the server closes the connection within 5 seconds.
+func closed(conn net.Conn) bool {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err := conn.Read(make([]byte, 1))
+	neterr, ok := err.(net.Error)
+	return err != nil && !(ok && neterr.Timeout())
+}
+
+func (s *InputSuite) Test_TcpServerLimits(c *C) {
+	t := NewTcpServer("127.0.0.1:0")
+	t.SetLimits(TcpLimits{MaxConnections: 2, MaxPerIP: 1})
+	c.Assert(t.Start(func(e *Event) {}), IsNil)
+	defer t.Stop()
+
+	first, err := net.Dial("tcp", t.Addr().String())
+	c.Assert(err, IsNil)
+	defer first.Close()
+	second, err := net.Dial("tcp", t.Addr().String())
+	c.Assert(err, IsNil)
+	defer second.Close()
+
+	c.Assert(closed(second), Equals, true)
+	c.Assert(t.connectionsLimited.Count(), Equals, int64(1))
+	c.Assert(t.connectionsActive.Count(), Equals, int64(1))
+
+	// Once the first connection is closed, another is accepted.
+	first.Close()
+	for i := 0; i < 500 && t.connectionsActive.Count() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	third, err := net.Dial("tcp", t.Addr().String())
+	c.Assert(err, IsNil)
+	defer third.Close()
+	third.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = third.Read(make([]byte, 1))
+	neterr, ok := err.(net.Error)
+	c.Assert(ok && neterr.Timeout(), Equals, true)
+}
+
+func (s *InputSuite) Test_TcpServerIdle(c *C) {
+	t := NewTcpServer("127.0.0.1:0")
+	t.SetLimits(TcpLimits{IdleTimeout: time.Millisecond})
+	c.Assert(t.Start(func(e *Event) {}), IsNil)
+	defer t.Stop()
+
+	conn, err := net.Dial("tcp", t.Addr().String())
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	c.Assert(closed(conn), Equals, true)
+	c.Assert(t.connectionsIdle.Count(), Equals, int64(1))
+}
+
+func (s *InputSuite) Test_TcpServerMultiline(c *C) {
+	t := NewTcpServer("127.0.0.1:0")
+	t.SetMultiline(Multiline{FlushTimeout: 50 * time.Millisecond, Whitespace: true})
+	events := make(chan *Event, 2)
+	c.Assert(t.Start(func(e *Event) { events <- e }), IsNil)
+	defer t.Stop()
+
+	conn, err := net.Dial("tcp", t.Addr().String())
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	_, err = conn.Write([]byte("<131>1 - host app 1 - boom\n<131>1 - host app 1 - \tat Main.main\n"))
+	c.Assert(err, IsNil)
+
+	select {
+	case e := <-events:
+		c.Assert(e.Raw, Equals, "<131>1 - host app 1 - boom\n\tat Main.main")
+	case <-time.After(5 * time.Second):
+		c.Fatal("event not flushed")
+	}
+	c.Assert(t.eventsMerged.Count(), Equals, int64(1))
+}
+
+func (s *InputSuite) Test_TcpServerRecovered(c *C) {
+	t := NewTcpServer("127.0.0.1:0")
+	t.SetMultiline(Multiline{FlushTimeout: time.Minute})
+	events := make(chan *Event, 2)
+	c.Assert(t.Start(func(e *Event) { events <- e }), IsNil)
+	defer t.Stop()
+
+	conn, err := net.Dial("tcp", t.Addr().String())
+	c.Assert(err, IsNil)
+	_, err = conn.Write([]byte("<134>1 - host app 1 - first\n<134>1 - host app 1 - last"))
+	c.Assert(err, IsNil)
+	conn.Close()
+
+	for _, expected := range []string{"<134>1 - host app 1 - first", "<134>1 - host app 1 - last"} {
+		select {
+		case e := <-events:
+			c.Assert(e.Raw, Equals, expected)
+		case <-time.After(5 * time.Second):
+			c.Fatal("event not received")
+		}
+	}
+	c.Assert(t.eventsRecovered.Count(), Equals, int64(1))
+}
+
+func (s *InputSuite) Test_UdpServerACL(c *C) {
+	u := NewUdpServer("127.0.0.1:0")
+	u.SetACL(NewACL(mustCIDRs(c, "10.0.0.0/8"), nil))
+	events := make(chan *Event, 1)
+	c.Assert(u.Start(func(e *Event) { events <- e }), IsNil)
+	defer u.Stop()
+
+	conn, err := net.Dial("udp", u.Addr().String())
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	_, err = conn.Write([]byte("<134>1 - - - - - hello"))
+	c.Assert(err, IsNil)
+
+	for i := 0; i < 500 && u.packetsRejected.Count() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(u.packetsRejected.Count(), Equals, int64(1))
+	c.Assert(events, HasLen, 0)
+}
+
+/*
+ * Queue tests
+ */
+
+func (s *InputSuite) Test_ParsePolicy(c *C) {
+	for _, name := range []string{"block", "drop-newest", "drop-oldest"} {
+		p, err := ParsePolicy(name)
+		c.Assert(err, IsNil)
+		c.Assert(p.String(), Equals, name)
+	}
+	_, err := ParsePolicy("drop")
+	c.Assert(err, NotNil)
+}
+
+func (s *InputSuite) Test_QueueDropNewest(c *C) {
+	q := NewQueue(2, DropNewest)
+	q.Put(NewEvent("a", ""))
+	q.Put(NewEvent("b", ""))
+	c.Assert(q.Saturated(), Equals, true)
+	q.Put(NewEvent("c", ""))
+
+	c.Assert((<-q.C).Raw, Equals, "a")
+	c.Assert((<-q.C).Raw, Equals, "b")
+	c.Assert(q.droppedNewest.Count(), Equals, int64(1))
+	c.Assert(q.droppedOldest.Count(), Equals, int64(0))
+	c.Assert(q.highWater.Value(), Equals, int64(2))
+}
+
+func (s *InputSuite) Test_QueueDropOldest(c *C) {
+	q := NewQueue(2, DropOldest)
+	q.Put(NewEvent("a", ""))
+	q.Put(NewEvent("b", ""))
+	q.Put(NewEvent("c", ""))
+
+	c.Assert((<-q.C).Raw, Equals, "b")
+	c.Assert((<-q.C).Raw, Equals, "c")
+	c.Assert(q.droppedNewest.Count(), Equals, int64(0))
+	c.Assert(q.droppedOldest.Count(), Equals, int64(1))
+	c.Assert(q.highWater.Value(), Equals, int64(2))
+}
+
+func (s *InputSuite) Test_QueueBlock(c *C) {
+	q := NewQueue(1, Block)
+	q.Put(NewEvent("a", ""))
+	done := make(chan bool)
+	go func() {
+		q.Put(NewEvent("b", ""))
+		done <- true
+	}()
+
+	select {
+	case <-done:
+		c.Fatal("Put did not block on a full queue")
+	case <-time.After(10 * time.Millisecond):
+	}
+	c.Assert((<-q.C).Raw, Equals, "a")
+	<-done
+	c.Assert((<-q.C).Raw, Equals, "b")
+}
+
+/*
+ * Benchmarks
+ */
+
+// BenchmarkStreamingParse measures how parsing throughput scales with the
+// number of workers. Run with -cpu to vary GOMAXPROCS.
+func BenchmarkStreamingParse(b *testing.B) {
+	line := "<134>1 2013-09-04T10:25:52.618085 ubuntu sshd 1999 - password accepted for user root from 10.0.0.1 port 22"
+	sources := make([]string, 16)
+	for i := range sources {
+		sources[i] = fmt.Sprintf("10.0.0.%d:514", i)
+	}
+	for _, workers := range []int{1, 2, 4, 8} {
+		for _, ordered := range []bool{false, true} {
+			b.Run(fmt.Sprintf("workers=%d,ordered=%t", workers, ordered), func(b *testing.B) {
+				p := NewRfc5424Parser()
+				in := make(chan *Event, 1024)
+				var wg sync.WaitGroup
+				wg.Add(b.N)
+				p.StreamingParse(in, workers, ordered, func(e *Event) { wg.Done() })
+
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					in <- &Event{Raw: line, Source: sources[i%len(sources)]}
+				}
+				wg.Wait()
+				b.StopTimer()
+				close(in)
+			})
+		}
+	}
 }
@@ -0,0 +1,153 @@
+package input
+
+import (
+	"regexp"
+	"strings"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// defaultFlushTimeout is how long a TcpServer waits for the rest of a
+// message if no FlushTimeout is set.
+const defaultFlushTimeout = time.Duration(1000 * time.Millisecond)
+
+// defaultMaxLines is how many lines a merged message may have if no
+// MaxLines is set.
+const defaultMaxLines = 256
+
+// Multiline configures how a TcpServer assembles messages which span
+// several lines. A partial message is flushed once no bytes have been
+// received for FlushTimeout. Lines without a Syslog header are always
+// appended to the message before them. In addition, a message whose MSG
+// starts with whitespace, starts with one of Prefixes, or matches one of
+// Patterns is merged into the message before it from the same host and
+// app, as when a sender writes each line of a stack trace as its own
+// Syslog message. A merged message is complete once it has MaxLines lines,
+// and any further continuation starts a new message.
+type Multiline struct {
+	FlushTimeout time.Duration
+	MaxLines     int
+	Whitespace   bool
+	Prefixes     []string
+	Patterns     []*regexp.Regexp
+}
+
+// flushTimeout returns how long to wait for the rest of a message.
+func (m Multiline) flushTimeout() time.Duration {
+	if m.FlushTimeout <= 0 {
+		return defaultFlushTimeout
+	}
+	return m.FlushTimeout
+}
+
+// maxLines returns how many lines a merged message may have.
+func (m Multiline) maxLines() int {
+	if m.MaxLines <= 0 {
+		return defaultMaxLines
+	}
+	return m.MaxLines
+}
+
+// merges returns whether any continuation rules are set.
+func (m Multiline) merges() bool {
+	return m.Whitespace || len(m.Prefixes) > 0 || len(m.Patterns) > 0
+}
+
+// continues returns whether a message whose MSG is msg continues the
+// message before it.
+func (m Multiline) continues(msg string) bool {
+	if m.Whitespace && msg != "" && isSpace(msg[0]) {
+		return true
+	}
+	for _, p := range m.Prefixes {
+		if strings.HasPrefix(msg, p) {
+			return true
+		}
+	}
+	for _, re := range m.Patterns {
+		if re.MatchString(msg) {
+			return true
+		}
+	}
+	return false
+}
+
+// A joiner merges messages which continue the message before them. Each
+// message is held back until the next shows whether it is continued, or
+// until the joiner is flushed.
+type joiner struct {
+	m      Multiline
+	merged metrics.Counter
+
+	pending   string
+	lines     int  // The number of lines merged into pending
+	parsed    bool // Whether pending has a valid header
+	host, app string
+}
+
+// newJoiner returns a joiner applying the continuation rules of m, counting
+// each message merged in merged.
+func newJoiner(m Multiline, merged metrics.Counter) *joiner {
+	return &joiner{m: m, merged: merged}
+}
+
+// push adds a complete message, returning the message before it if that is
+// now complete. If no continuation rules are set, event is returned at once.
+// If the message before it already has the most lines allowed, event starts
+// a new message even if it is a continuation.
+func (j *joiner) push(event string) (string, bool) {
+	if !j.m.merges() {
+		return event, true
+	}
+	host, app, msg, parsed := splitHeader(event)
+	if j.pending != "" && j.parsed && parsed && j.lines < j.m.maxLines() &&
+		host == j.host && app == j.app && j.m.continues(msg) {
+		j.pending += "\n" + msg
+		j.lines++
+		j.merged.Inc(1)
+		return "", false
+	}
+
+	done, ok := j.flush()
+	j.pending = event
+	j.lines = 1
+	j.parsed = parsed
+	j.host, j.app = host, app
+	return done, ok
+}
+
+// splitHeader returns the HOSTNAME, APP-NAME and MSG of a Syslog message,
+// and whether it has a complete header. Only the shape of the header is
+// checked, since the message is fully parsed later.
+func splitHeader(raw string) (host, app, msg string, ok bool) {
+	// Skip PRI and VERSION, which the Delimiter has already found.
+	i := strings.IndexByte(raw, '>')
+	if i < 0 || i+2 > len(raw) {
+		return "", "", "", false
+	}
+	s := raw[i+2:]
+
+	// TIMESTAMP, HOSTNAME, APP-NAME, PROCID and MSGID are each preceded by
+	// a single space, as is MSG.
+	var tokens [5]string
+	for t := range tokens {
+		if len(s) < 2 || s[0] != ' ' || s[1] == ' ' {
+			return "", "", "", false
+		}
+		s = s[1:]
+		end := strings.IndexByte(s, ' ')
+		if end < 0 {
+			return "", "", "", false
+		}
+		tokens[t], s = s[:end], s[end:]
+	}
+	return tokens[1], tokens[2], s[1:], true
+}
+
+// flush returns the message held back, if any.
+func (j *joiner) flush() (string, bool) {
+	done := j.pending
+	j.pending = ""
+	return done, done != ""
+}
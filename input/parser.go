@@ -1,101 +1,536 @@
 package input
 
 import (
-	"encoding/json"
-	"regexp"
+	"hash/fnv"
+	"net"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
 
 	metrics "github.com/rcrowley/go-metrics"
 )
 
+const (
+	// The number of Events buffered for each worker when parsing in order.
+	shardBufSize = 64
+
+	// The number of recent parse failures retained.
+	failuresSize = 100
+
+	// The highest valid PRI.
+	maxPriority = 191
+
+	// The longest PROCID accepted in lenient mode.
+	maxProcIdLen = 128
+
+	// The layout of timestamps without a time zone, which are taken to be
+	// UTC.
+	zonelessLayout = "2006-01-02T15:04:05.999999999"
+)
+
+// The header fields of a Syslog message, as named in a ParsedMessage.
+const (
+	FieldPriority  = "priority"
+	FieldVersion   = "version"
+	FieldTimestamp = "timestamp"
+	FieldHost      = "host"
+	FieldApp       = "app"
+	FieldPid       = "pid"
+	FieldMsgId     = "msgid"
+	FieldMessage   = "message"
+)
+
+var fields = []string{FieldPriority, FieldVersion, FieldTimestamp, FieldHost, FieldApp, FieldPid, FieldMsgId, FieldMessage}
+
+// Codes classifying why a field could not be parsed.
+const (
+	CodeMissing    = "missing"
+	CodeInvalid    = "invalid"
+	CodeOutOfRange = "out_of_range"
+)
+
+var codes = []string{CodeMissing, CodeInvalid, CodeOutOfRange}
+
+// A ParseError describes why a message could not be parsed.
+type ParseError struct {
+	Field  string // The field which could not be parsed
+	Code   string // One of the Code constants
+	Reason string
+}
+
+func (e *ParseError) Error() string {
+	return e.Field + ": " + e.Reason
+}
+
 // A Rfc5424Parser parses Syslog messages.
 type Rfc5424Parser struct {
-	regex    *regexp.Regexp
-	registry metrics.Registry
-	parsed   metrics.Counter
-	dropped  metrics.Counter
+	lenient     bool
+	requireZone bool
+	hostname    string // Set if metadata is to be added
+	layout      string
+	maxSkew     time.Duration
+	deadLetter  func(e *Event, reason string)
+	redact      func(e *Event)
+	failures    *Failures
+
+	registry     metrics.Registry
+	parsed       metrics.Counter
+	parsedLax    metrics.Counter
+	skewed       metrics.Counter
+	dropped      metrics.Counter
+	droppedBy    map[string]metrics.Counter // By field and code
+	deadLettered metrics.Counter
 }
 
 // ParsedMessage represents a fully parsed Syslog message.
 type ParsedMessage struct {
-	Priority  int    `json:"priority"`
-	Version   int    `json:"version"`
-	Timestamp string `json:"timestamp"`
-	Host      string `json:"host"`
-	App       string `json:"app"`
-	Pid       int    `json:"pid"`
-	MsgId     string `json:"msgid"`
-	Message   string `json:"message"`
+	Priority     int    `json:"priority"`
+	Facility     int    `json:"facility"`
+	FacilityName string `json:"facility_name"`
+	Severity     int    `json:"severity"`
+	SeverityName string `json:"severity_name"`
+	Version      int    `json:"version"`
+	Timestamp    string `json:"timestamp"`
+	Host         string `json:"host"`
+	App          string `json:"app"`
+	Pid          int    `json:"pid"`
+	MsgId        string `json:"msgid"`
+	Message      string `json:"message"`
+
+	// Set in lenient mode. ProcId is the PROCID as received, and Lenient
+	// is set if the message was not valid RFC5424, in which case any
+	// unparsed remainder of the message is in Message.
+	ProcId  string `json:"procid,omitempty"`
+	Lenient bool   `json:"lenient,omitempty"`
+
+	// Where and when the message was received, if requested.
+	Meta *Metadata `json:"meta,omitempty"`
+
+	// Set if the message stands for this many identical messages which
+	// were suppressed.
+	Repeated int64 `json:"repeated,omitempty"`
+
+	// Set if the message was sampled, to the number of messages it stands
+	// for.
+	SampleRate float64 `json:"sample_rate,omitempty"`
+
+	// The TIMESTAMP in UTC, or when the message was received if it has
+	// none.
+	Time time.Time `json:"-"`
+}
+
+// messageFields returns the value of each field of the message, by the name
+// of the field in JSON.
+var messageFields = map[string]func(m *ParsedMessage) string{
+	"priority":      func(m *ParsedMessage) string { return strconv.Itoa(m.Priority) },
+	"facility":      func(m *ParsedMessage) string { return strconv.Itoa(m.Facility) },
+	"facility_name": func(m *ParsedMessage) string { return m.FacilityName },
+	"severity":      func(m *ParsedMessage) string { return strconv.Itoa(m.Severity) },
+	"severity_name": func(m *ParsedMessage) string { return m.SeverityName },
+	"version":       func(m *ParsedMessage) string { return strconv.Itoa(m.Version) },
+	"timestamp":     func(m *ParsedMessage) string { return m.Timestamp },
+	"host":          func(m *ParsedMessage) string { return m.Host },
+	"app":           func(m *ParsedMessage) string { return m.App },
+	"pid":           func(m *ParsedMessage) string { return strconv.Itoa(m.Pid) },
+	"procid":        func(m *ParsedMessage) string { return m.ProcId },
+	"msgid":         func(m *ParsedMessage) string { return m.MsgId },
+	"message":       func(m *ParsedMessage) string { return m.Message },
+}
+
+// IsField returns whether name is the JSON name of a field of
+// ParsedMessage, other than its Metadata.
+func IsField(name string) bool {
+	_, ok := messageFields[name]
+	return ok
+}
+
+// Field returns the value of the field with the given JSON name as a
+// string, and whether there is such a field.
+func (m *ParsedMessage) Field(name string) (string, bool) {
+	f, ok := messageFields[name]
+	if !ok {
+		return "", false
+	}
+	return f(m), true
+}
+
+// Metadata records where and when a message was received.
+type Metadata struct {
+	Received  string `json:"received"`
+	PeerIP    string `json:"peer_ip,omitempty"`
+	PeerPort  int    `json:"peer_port,omitempty"`
+	Listener  string `json:"listener,omitempty"`
+	Protocol  string `json:"protocol,omitempty"`
+	Collector string `json:"collector"`
 }
 
 // NewRfc5424Parser Returns an initialized Rfc5424Parser.
 func NewRfc5424Parser() *Rfc5424Parser {
-	leading := `(?s)`
-	pri := `<([0-9]{1,3})>`
-	ver := `([0-9])`
-	ts := `([^ ]+)`
-	host := `([^ ]+)`
-	app := `([^ ]+)`
-	pid := `([0-9]{1,5})`
-	id := `([\w-]+)`
-	msg := `(.+$)`
-
-	p := &Rfc5424Parser{}
-	r := regexp.MustCompile(leading + pri + ver + `\s` + ts + `\s` + host + `\s` + app + `\s` + pid + `\s` + id + `\s` + msg)
-	p.regex = r
+	p := &Rfc5424Parser{layout: time.RFC3339Nano}
+	p.failures = NewFailures(failuresSize)
 
 	// Initialize metrics
 	p.registry = metrics.NewRegistry()
 	p.parsed = metrics.NewCounter()
+	p.parsedLax = metrics.NewCounter()
+	p.skewed = metrics.NewCounter()
 	p.dropped = metrics.NewCounter()
+	p.deadLettered = metrics.NewCounter()
 	p.registry.Register("events.parsed", p.parsed)
+	p.registry.Register("events.parsed.lenient", p.parsedLax)
+	p.registry.Register("events.skewed", p.skewed)
 	p.registry.Register("events.dropped", p.dropped)
+	p.registry.Register("events.deadlettered", p.deadLettered)
+	p.droppedBy = make(map[string]metrics.Counter)
+	for _, f := range fields {
+		for _, code := range codes {
+			key := f + "." + code
+			p.droppedBy[key] = metrics.NewCounter()
+			p.registry.Register("events.dropped."+key, p.droppedBy[key])
+		}
+	}
 	return p
 }
 
+// SetLenient sets whether messages which are not valid RFC5424 are parsed
+// as far as possible, rather than dropped. It must be called before
+// StreamingParse.
+func (p *Rfc5424Parser) SetLenient(lenient bool) {
+	p.lenient = lenient
+}
+
+// SetRequireZone sets whether timestamps without a time zone are invalid,
+// rather than taken to be UTC. In lenient mode they are still accepted, but
+// the message is marked lenient. It must be called before StreamingParse.
+func (p *Rfc5424Parser) SetRequireZone(require bool) {
+	p.requireZone = require
+}
+
+// SetTimestamp sets the layout, as understood by time.Format, in which
+// timestamps are written, and how far a timestamp may differ from when the
+// message was received before the message is counted as skewed. If maxSkew
+// is 0, skew is not counted. It must be called before StreamingParse.
+func (p *Rfc5424Parser) SetTimestamp(layout string, maxSkew time.Duration) {
+	p.layout = layout
+	p.maxSkew = maxSkew
+}
+
+// SetMetadata sets whether parsed messages include Metadata recording where
+// and when they were received. It must be called before StreamingParse.
+func (p *Rfc5424Parser) SetMetadata(enabled bool) {
+	p.hostname = ""
+	if enabled {
+		p.hostname = hostname()
+	}
+}
+
+// SetDeadLetter sets the function to which StreamingParse passes Events which
+// cannot be parsed, along with the reason. It must be called before
+// StreamingParse.
+func (p *Rfc5424Parser) SetDeadLetter(f func(e *Event, reason string)) {
+	p.deadLetter = f
+}
+
+// SetRedact sets a function StreamingParse applies to Events which cannot
+// be parsed, before they are recorded in Failures or passed to the
+// dead-letter function, so that secrets in them can be masked. It must be
+// called before StreamingParse.
+func (p *Rfc5424Parser) SetRedact(f func(e *Event)) {
+	p.redact = f
+}
+
 // Statistics returns an object storing statistics, which supports JSON
 // marshalling.
 func (p *Rfc5424Parser) Statistics() (metrics.Registry, error) {
 	return p.registry, nil
 }
 
-// StreamingParse emits parsed Syslog messages on the returned channel. If
-// there are any parsing errors, the message is dropped.
-func (p *Rfc5424Parser) StreamingParse(in chan string) (chan string, error) {
-	ch := make(chan string)
+// Failures returns the most recent Events which StreamingParse could not
+// parse.
+func (p *Rfc5424Parser) Failures() *Failures {
+	return p.failures
+}
+
+// StreamingParse parses the Events received on in, using the given number
+// of worker goroutines, and passes each parsed Event to f. If there are any
+// parsing errors, the Event is passed to the dead-letter function, if set,
+// and otherwise dropped. If ordered is set, Events from the
+// same source are always parsed by the same worker, so the order of Events
+// from each source is preserved. The returned channel is closed once in
+// has been closed and every worker has finished.
+func (p *Rfc5424Parser) StreamingParse(in chan *Event, workers int, ordered bool, f func(*Event)) chan struct{} {
+	if workers < 1 {
+		workers = 1
+	}
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(workers)
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	if !ordered || workers == 1 {
+		for i := 0; i < workers; i++ {
+			go func() {
+				defer wg.Done()
+				p.work(in, f)
+			}()
+		}
+		return done
+	}
 
+	shards := make([]chan *Event, workers)
+	for i := range shards {
+		shards[i] = make(chan *Event, shardBufSize)
+		go func(shard chan *Event) {
+			defer wg.Done()
+			p.work(shard, f)
+		}(shards[i])
+	}
 	go func() {
-		for m := range in {
-			parsed := p.Parse(m)
-			if parsed == nil {
-				continue
+		for e := range in {
+			shards[shard(e.Source, workers)] <- e
+		}
+		for _, s := range shards {
+			close(s)
+		}
+	}()
+	return done
+}
+
+// work parses the Events received on in, passing each parsed Event to f.
+func (p *Rfc5424Parser) work(in chan *Event, f func(*Event)) {
+	for e := range in {
+		parsed, err := p.parseAt(e.Raw, e.Received)
+		if err != nil {
+			if p.redact != nil {
+				p.redact(e)
 			}
-			b, err := json.Marshal(*parsed)
-			if err != nil {
-				continue
+			p.failures.Add(NewDeadLetter(e, err.Error()))
+			if p.deadLetter != nil {
+				p.deadLettered.Inc(1)
+				p.deadLetter(e, err.Error())
 			}
-			event := string(b)
-			ch <- event
+			continue
 		}
-	}()
-	return ch, nil
+		if p.hostname != "" {
+			parsed.Meta = p.metadata(e)
+		}
+		e.Parsed = parsed
+		f(e)
+	}
+}
+
+// metadata returns the Metadata for the Event.
+func (p *Rfc5424Parser) metadata(e *Event) *Metadata {
+	m := &Metadata{
+		Received:  e.Received.UTC().Format(p.layout),
+		Listener:  e.Listener,
+		Protocol:  e.Protocol,
+		Collector: p.hostname,
+	}
+	if host, port, err := net.SplitHostPort(e.Source); err == nil {
+		m.PeerIP = host
+		m.PeerPort, _ = strconv.Atoi(port)
+	}
+	return m
+}
+
+// shard returns which of n shards Events from source belong to.
+func shard(source string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(source))
+	return int(h.Sum32() % uint32(n))
 }
 
-// Parse takes a raw message and returns a parsed message. If no match,
-// nil is returned.
-func (p *Rfc5424Parser) Parse(raw string) *ParsedMessage {
-	m := p.regex.FindStringSubmatch(raw)
-	if m == nil || len(m) != 9 {
+// Parse takes a raw message and returns a parsed message. If the message
+// cannot be parsed, a *ParseError is returned, identifying the field at
+// fault. Any characters before the PRI are ignored. In lenient mode only an
+// invalid PRI is an error. A message without a timestamp is taken to have
+// been sent now, and a timestamp without a time zone is taken to be UTC
+// unless SetRequireZone is set.
+func (p *Rfc5424Parser) Parse(raw string) (*ParsedMessage, error) {
+	return p.parseAt(raw, time.Now())
+}
+
+// parseAt parses a raw message received at the given time.
+func (p *Rfc5424Parser) parseAt(raw string, received time.Time) (*ParsedMessage, error) {
+	m, err := parse(raw, p.lenient, p.requireZone)
+	if err != nil {
 		p.dropped.Inc(1)
-		return nil
+		p.droppedBy[err.Field+"."+err.Code].Inc(1)
+		return nil, err
 	}
+
+	if m.Time.IsZero() {
+		m.Time = received.UTC()
+	} else if p.maxSkew > 0 {
+		if skew := m.Time.Sub(received); skew > p.maxSkew || skew < -p.maxSkew {
+			p.skewed.Inc(1)
+		}
+	}
+	m.Timestamp = m.Time.Format(p.layout)
+
 	p.parsed.Inc(1)
+	if m.Lenient {
+		p.parsedLax.Inc(1)
+	}
+	return m, nil
+}
+
+// parse parses the message, field by field. If lenient is set, only the PRI
+// must be valid. NILVALUE is then accepted for every header field, PROCID may
+// be any token, and parsing stops at the first field which is missing or
+// invalid, leaving the remainder of the message in Message. If requireZone
+// is set, a timestamp without a time zone is invalid, rather than UTC.
+func parse(raw string, lenient, requireZone bool) (*ParsedMessage, *ParseError) {
+	m := &ParsedMessage{}
+	s := raw
+
+	// stop returns the ParseError, or in lenient mode the message parsed so
+	// far, with the remainder starting at rest.
+	stop := func(field, code, reason, rest string) (*ParsedMessage, *ParseError) {
+		if !lenient {
+			return nil, &ParseError{field, code, reason}
+		}
+		m.Lenient = true
+		m.Message = strings.TrimLeftFunc(rest, unicode.IsSpace)
+		return m, nil
+	}
+
+	// PRI and VERSION are not separated by whitespace.
+	start := findHeader(s, lenient)
+	if start < 0 {
+		return nil, &ParseError{FieldPriority, CodeMissing, "missing"}
+	}
+	s = s[start+1:]
+	end := strings.IndexByte(s, '>')
+	if end < 1 || end > 3 || !isDigits(s[:end]) {
+		return nil, &ParseError{FieldPriority, CodeInvalid, "not 1 to 3 digits enclosed in <>"}
+	}
+	m.Priority, _ = strconv.Atoi(s[:end])
+	if m.Priority > maxPriority {
+		return nil, &ParseError{FieldPriority, CodeOutOfRange, "out of range"}
+	}
+	m.Facility, m.Severity = m.Priority/8, m.Priority%8
+	m.FacilityName, m.SeverityName = FacilityName(m.Facility), SeverityName(m.Severity)
+	s = s[end+1:]
+	switch {
+	case len(s) >= 2 && isDigits(s[:1]) && isSpace(s[1]):
+		m.Version = int(s[0] - '0')
+	case lenient && len(s) >= 2 && s[0] == '-' && isSpace(s[1]):
+		m.Lenient = true
+	default:
+		return stop(FieldVersion, CodeInvalid, "not a single digit", s)
+	}
+	s = s[1:]
+
+	// The remaining header fields are separated by single whitespace.
+	var tokens [5]string
+	for i, f := range []string{FieldTimestamp, FieldHost, FieldApp, FieldPid, FieldMsgId} {
+		if len(s) < 2 || !isSpace(s[0]) || isSpace(s[1]) {
+			return stop(f, CodeMissing, "missing", s)
+		}
+		rest := s
+		s = s[1:]
+		end := strings.IndexFunc(s, unicode.IsSpace)
+		if end < 0 {
+			end = len(s)
+		}
+		tokens[i], s = s[:end], s[end:]
+
+		switch f {
+		case FieldTimestamp:
+			if tokens[i] == "-" {
+				break
+			}
+			t, err := time.Parse(time.RFC3339Nano, tokens[i])
+			if err != nil {
+				zoneless, zerr := time.Parse(zonelessLayout, tokens[i])
+				switch {
+				case zerr != nil:
+					return stop(FieldTimestamp, CodeInvalid, "not RFC3339", rest)
+				case requireZone && !lenient:
+					return stop(FieldTimestamp, CodeInvalid, "no time zone", rest)
+				case requireZone:
+					m.Lenient = true
+				}
+				t = zoneless
+			}
+			m.Time = t.UTC()
+		case FieldHost:
+			m.Host = tokens[i]
+		case FieldApp:
+			m.App = tokens[i]
+		case FieldPid:
+			switch {
+			case tokens[i] == "-":
+				// NILVALUE, leaving Pid 0.
+			case len(tokens[i]) <= 5 && isDigits(tokens[i]):
+				m.Pid, _ = strconv.Atoi(tokens[i])
+			case !lenient || len(tokens[i]) > maxProcIdLen:
+				return stop(FieldPid, CodeInvalid, "not 1 to 5 digits", rest)
+			default:
+				m.Lenient = true
+			}
+			if lenient {
+				m.ProcId = tokens[i]
+			}
+		case FieldMsgId:
+			if strings.IndexFunc(tokens[i], func(r rune) bool {
+				return !(r == '-' || r == '_' || isAlnum(r))
+			}) >= 0 {
+				return stop(FieldMsgId, CodeInvalid, "contains characters other than letters, digits, _ and -", rest)
+			}
+			m.MsgId = tokens[i]
+		}
+	}
+
+	if len(s) < 2 || !isSpace(s[0]) {
+		return stop(FieldMessage, CodeMissing, "missing", s)
+	}
+	m.Message = s[1:]
+	return m, nil
+}
+
+// findHeader returns the index of the first '<' in s which starts a PRI
+// and VERSION, "<1-3 digits>" followed by a digit and whitespace, or in
+// lenient mode by "-" and whitespace. Any text before it is ignored. If
+// there is none, the first '<' is returned, so that the invalid header can
+// be reported, or -1 if there is no '<'.
+func findHeader(s string, lenient bool) int {
+	first := strings.IndexByte(s, '<')
+	for i := first; i >= 0; {
+		end := strings.IndexByte(s[i+1:], '>') + i + 1
+		if end > i+1 && end <= i+4 && isDigits(s[i+1:end]) && len(s) >= end+3 && isSpace(s[end+2]) &&
+			(isDigits(s[end+1:end+2]) || lenient && s[end+1] == '-') {
+			return i
+		}
+		next := strings.IndexByte(s[i+1:], '<')
+		if next < 0 {
+			break
+		}
+		i += next + 1
+	}
+	return first
+}
 
-	// Errors are ignored, because the regex shouldn't match if the
-	// following ain't numbers.
-	pri, _ := strconv.Atoi(m[1])
-	ver, _ := strconv.Atoi(m[2])
-	pid, _ := strconv.Atoi(m[6])
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return len(s) > 0
+}
+
+func isSpace(b byte) bool {
+	return unicode.IsSpace(rune(b))
+}
 
-	return &ParsedMessage{pri, ver, m[3], m[4], m[5], pid, m[7], m[8]}
+func isAlnum(r rune) bool {
+	return r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r))
 }
@@ -0,0 +1,110 @@
+package input
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Peer records the activity of a single remote host.
+type Peer struct {
+	Host      string    `json:"host"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Events    int64     `json:"events"`
+	Bytes     int64     `json:"bytes"`
+}
+
+// maxPeers is the number of hosts a PeerTracker records, so that spoofed
+// or churning senders cannot grow it without bound.
+const maxPeers = 100000
+
+// A PeerTracker records per-host activity for a server. Hosts are keyed
+// by IP address, so all TCP connections from a host share an entry. Once
+// it records max hosts, the quarter seen least recently are forgotten.
+type PeerTracker struct {
+	mu    sync.Mutex
+	peers map[string]*Peer
+	max   int
+}
+
+// NewPeerTracker returns an initialized PeerTracker.
+func NewPeerTracker() *PeerTracker {
+	return &PeerTracker{peers: make(map[string]*Peer), max: maxPeers}
+}
+
+// Seen records an event of n bytes, received at now, from the given remote
+// address.
+func (t *PeerTracker) Seen(addr string, n int, now time.Time) {
+	host := peerHost(addr)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p, ok := t.peers[host]
+	if !ok {
+		if len(t.peers) >= t.max {
+			t.evict()
+		}
+		p = &Peer{Host: host, FirstSeen: now}
+		t.peers[host] = p
+	}
+	p.LastSeen = now
+	p.Events++
+	p.Bytes += int64(n)
+}
+
+// evict forgets the quarter of the hosts seen least recently, so that
+// eviction is rare however many hosts are seen.
+func (t *PeerTracker) evict() {
+	peers := make([]*Peer, 0, len(t.peers))
+	for _, p := range t.peers {
+		peers = append(peers, p)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].LastSeen.Before(peers[j].LastSeen) })
+	for _, p := range peers[:len(peers)/4+1] {
+		delete(t.peers, p.Host)
+	}
+}
+
+// Expire forgets the hosts last seen before the given time, returning how
+// many were forgotten.
+func (t *PeerTracker) Expire(before time.Time) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for host, p := range t.peers {
+		if p.LastSeen.Before(before) {
+			delete(t.peers, host)
+			n++
+		}
+	}
+	return n
+}
+
+// Peers returns a copy of the activity of every host seen, sorted by host.
+func (t *PeerTracker) Peers() []Peer {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	peers := make([]Peer, 0, len(t.peers))
+	for _, p := range t.peers {
+		peers = append(peers, *p)
+	}
+	sort.Sort(byHost(peers))
+	return peers
+}
+
+// peerHost strips any port from the address.
+func peerHost(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+type byHost []Peer
+
+func (p byHost) Len() int           { return len(p) }
+func (p byHost) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p byHost) Less(i, j int) bool { return p[i].Host < p[j].Host }
@@ -0,0 +1,135 @@
+package input
+
+import (
+	"fmt"
+	"sync"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// A Policy determines what a Queue does with a message when it is full.
+type Policy int
+
+const (
+	// Block waits until there is room for the message.
+	Block Policy = iota
+	// DropNewest discards the message.
+	DropNewest
+	// DropOldest discards the oldest message in the Queue to make room.
+	DropOldest
+)
+
+var policyNames = map[Policy]string{
+	Block:      "block",
+	DropNewest: "drop-newest",
+	DropOldest: "drop-oldest",
+}
+
+// ParsePolicy returns the Policy with the given name.
+func ParsePolicy(name string) (Policy, error) {
+	for p, n := range policyNames {
+		if n == name {
+			return p, nil
+		}
+	}
+	return Block, fmt.Errorf("unknown policy %q, must be one of block, drop-newest or drop-oldest", name)
+}
+
+// String returns the name of the Policy.
+func (p Policy) String() string {
+	return policyNames[p]
+}
+
+// A Queue is a channel of Events between stages of the pipeline, which
+// applies a Policy when it is full.
+type Queue struct {
+	C      chan *Event
+	policy Policy
+
+	mu            sync.Mutex
+	registry      metrics.Registry
+	droppedNewest metrics.Counter
+	droppedOldest metrics.Counter
+	highWater     metrics.Gauge
+}
+
+// NewQueue returns a Queue which buffers up to capacity Events. Policies
+// other than Block require a non-zero capacity.
+func NewQueue(capacity int, policy Policy) *Queue {
+	q := &Queue{
+		C:      make(chan *Event, capacity),
+		policy: policy,
+	}
+
+	q.registry = metrics.NewRegistry()
+	q.droppedNewest = metrics.NewCounter()
+	q.droppedOldest = metrics.NewCounter()
+	q.highWater = metrics.NewGauge()
+	q.registry.Register("events.dropped.newest", q.droppedNewest)
+	q.registry.Register("events.dropped.oldest", q.droppedOldest)
+	q.registry.Register("depth.highwater", q.highWater)
+	q.registry.Register("depth", metrics.NewFunctionalGauge(func() int64 {
+		return int64(len(q.C))
+	}))
+	q.registry.Register("capacity", metrics.NewFunctionalGauge(func() int64 {
+		return int64(cap(q.C))
+	}))
+	return q
+}
+
+// Statistics returns an object storing statistics, which supports JSON
+// marshalling.
+func (q *Queue) Statistics() (metrics.Registry, error) {
+	return q.registry, nil
+}
+
+// Policy returns the Policy applied when the Queue is full.
+func (q *Queue) Policy() Policy {
+	return q.policy
+}
+
+// Put adds the Event to the Queue, applying the Policy if it is full.
+func (q *Queue) Put(e *Event) {
+	switch q.policy {
+	case Block:
+		q.C <- e
+	case DropNewest:
+		select {
+		case q.C <- e:
+		default:
+			q.droppedNewest.Inc(1)
+			return
+		}
+	case DropOldest:
+		for sent := false; !sent; {
+			select {
+			case q.C <- e:
+				sent = true
+			default:
+				// Full, so make room. A consumer may have made room
+				// first, in which case nothing is dropped.
+				select {
+				case <-q.C:
+					q.droppedOldest.Inc(1)
+				default:
+				}
+			}
+		}
+	}
+	q.updateHighWater()
+}
+
+// Saturated returns whether the Queue is full. An unbuffered Queue is never
+// considered saturated.
+func (q *Queue) Saturated() bool {
+	return cap(q.C) > 0 && len(q.C) >= cap(q.C)
+}
+
+func (q *Queue) updateHighWater() {
+	depth := int64(len(q.C))
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if depth > q.highWater.Value() {
+		q.highWater.Update(depth)
+	}
+}
@@ -0,0 +1,152 @@
+package input
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// An Alert describes a host which has stopped sending logs.
+type Alert struct {
+	Host     string    `json:"host"`
+	LastSeen time.Time `json:"last_seen"`
+	Raised   time.Time `json:"raised"`
+	Events   int64     `json:"events"`
+}
+
+// silenceExpiry is how many times the threshold a host may be silent before
+// it is forgotten, along with any Alert for it.
+const silenceExpiry = 10
+
+// A SilenceMonitor watches the hosts recorded by a set of PeerTrackers, and
+// raises an Alert when a host which regularly sends logs stops for longer
+// than the threshold. The Alert is cleared once the host sends again, or
+// once it has been silent for silenceExpiry times the threshold, when the
+// host is forgotten.
+type SilenceMonitor struct {
+	threshold time.Duration
+	minEvents int64
+
+	mu       sync.Mutex
+	trackers []*PeerTracker
+	alerts   map[string]*Alert
+
+	registry     metrics.Registry
+	alertsRaised metrics.Counter
+	hostsSilent  metrics.Gauge
+}
+
+// NewSilenceMonitor returns a SilenceMonitor. Only hosts which have sent at
+// least minEvents events are considered to send logs regularly.
+func NewSilenceMonitor(threshold time.Duration, minEvents int64, trackers ...*PeerTracker) *SilenceMonitor {
+	m := &SilenceMonitor{
+		threshold: threshold,
+		minEvents: minEvents,
+		trackers:  trackers,
+		alerts:    make(map[string]*Alert),
+	}
+
+	m.registry = metrics.NewRegistry()
+	m.alertsRaised = metrics.NewCounter()
+	m.hostsSilent = metrics.NewGauge()
+	m.registry.Register("alerts.raised", m.alertsRaised)
+	m.registry.Register("hosts.silent", m.hostsSilent)
+	return m
+}
+
+// Statistics returns an object storing statistics, which supports JSON
+// marshalling.
+func (m *SilenceMonitor) Statistics() (metrics.Registry, error) {
+	return m.registry, nil
+}
+
+// Start instructs the SilenceMonitor to check for silent hosts every
+// interval. A synthetic Syslog event is sent for every Alert raised.
+func (m *SilenceMonitor) Start(interval time.Duration, f func(*Event)) {
+	go func() {
+		for now := range time.Tick(interval) {
+			for _, a := range m.Check(now) {
+				f(NewSyntheticEvent(now, m.message(a)))
+			}
+		}
+	}()
+}
+
+// SetTrackers replaces the PeerTrackers watched, for example when a server
+// is replaced.
+func (m *SilenceMonitor) SetTrackers(trackers ...*PeerTracker) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.trackers = trackers
+}
+
+// Check compares the activity of every host against the threshold, as of
+// now, and returns any newly raised Alerts.
+func (m *SilenceMonitor) Check(now time.Time) []Alert {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// A host may be known to more than one tracker, so merge activity.
+	hosts := make(map[string]Peer)
+	for _, t := range m.trackers {
+		t.Expire(now.Add(-silenceExpiry * m.threshold))
+		for _, p := range t.Peers() {
+			h, ok := hosts[p.Host]
+			if !ok || p.LastSeen.After(h.LastSeen) {
+				h.Host = p.Host
+				h.LastSeen = p.LastSeen
+			}
+			h.Events += p.Events
+			hosts[p.Host] = h
+		}
+	}
+
+	var raised []Alert
+	for _, h := range hosts {
+		silent := now.Sub(h.LastSeen) > m.threshold
+		_, alerted := m.alerts[h.Host]
+		switch {
+		case silent && !alerted && h.Events >= m.minEvents:
+			a := &Alert{Host: h.Host, LastSeen: h.LastSeen, Raised: now, Events: h.Events}
+			m.alerts[h.Host] = a
+			raised = append(raised, *a)
+			m.alertsRaised.Inc(1)
+		case !silent && alerted:
+			delete(m.alerts, h.Host)
+		}
+	}
+	for host := range m.alerts {
+		if _, ok := hosts[host]; !ok {
+			delete(m.alerts, host)
+		}
+	}
+	m.hostsSilent.Update(int64(len(m.alerts)))
+	return raised
+}
+
+// Alerts returns the Alerts currently raised, sorted by host.
+func (m *SilenceMonitor) Alerts() []Alert {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	alerts := make([]Alert, 0, len(m.alerts))
+	for _, a := range m.alerts {
+		alerts = append(alerts, *a)
+	}
+	sort.Sort(alertsByHost(alerts))
+	return alerts
+}
+
+// message returns a message describing the Alert.
+func (m *SilenceMonitor) message(a Alert) string {
+	return fmt.Sprintf("host %s silent for %s, last seen %s",
+		a.Host, a.Raised.Sub(a.LastSeen).Truncate(time.Second), a.LastSeen.Format(time.RFC3339))
+}
+
+type alertsByHost []Alert
+
+func (a alertsByHost) Len() int           { return len(a) }
+func (a alertsByHost) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a alertsByHost) Less(i, j int) bool { return a[i].Host < a[j].Host }
@@ -0,0 +1,98 @@
+package output
+
+import (
+	"bufio"
+	"os"
+	"sync"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// The interval at which a FileWriter flushes buffered messages to disk.
+const fileFlushInterval = time.Second
+
+// A FileWriter appends messages to a file, one per line.
+type FileWriter struct {
+	mu     sync.Mutex
+	file   *os.File
+	writer *bufio.Writer
+	done   chan struct{}
+
+	registry metrics.Registry
+	msgTx    metrics.Counter
+	bytesTx  metrics.Counter
+	msgErr   metrics.Counter
+}
+
+// NewFileWriter returns a FileWriter appending to the file at path, which
+// is created if necessary.
+func NewFileWriter(path string) (*FileWriter, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	w := &FileWriter{
+		file:     f,
+		writer:   bufio.NewWriter(f),
+		done:     make(chan struct{}),
+		registry: metrics.NewRegistry(),
+		msgTx:    metrics.NewCounter(),
+		bytesTx:  metrics.NewCounter(),
+		msgErr:   metrics.NewCounter(),
+	}
+
+	w.registry.Register("messages.written", w.msgTx)
+	w.registry.Register("messages.bytes.written", w.bytesTx)
+	w.registry.Register("messages.errors", w.msgErr)
+
+	go func() {
+		ticker := time.NewTicker(fileFlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				w.Flush()
+			case <-w.done:
+				return
+			}
+		}
+	}()
+	return w, nil
+}
+
+// Write appends the message to the file. Newlines within the message are
+// not escaped, so messages should be encoded to a single line.
+func (w *FileWriter) Write(s string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, err := w.writer.WriteString(s + "\n"); err != nil {
+		w.msgErr.Inc(1)
+		return
+	}
+	w.msgTx.Inc(1)
+	w.bytesTx.Inc(int64(len(s)))
+}
+
+// Flush writes any buffered messages to the file.
+func (w *FileWriter) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.writer.Flush()
+}
+
+// Statistics returns an object storing statistics, which supports JSON
+// marshalling.
+func (w *FileWriter) Statistics() (metrics.Registry, error) {
+	return w.registry, nil
+}
+
+// Close flushes any buffered messages, and closes the file.
+func (w *FileWriter) Close() error {
+	close(w.done)
+	if err := w.Flush(); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
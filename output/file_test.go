@@ -0,0 +1,92 @@
+package output
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/otoolep/syslog-gollector/input"
+	. "gopkg.in/check.v1"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+type OutputSuite struct{}
+
+var _ = Suite(&OutputSuite{})
+
+func (s *OutputSuite) Test_FileWriter(c *C) {
+	path := filepath.Join(c.MkDir(), "dead.log")
+	w, err := NewFileWriter(path)
+	c.Assert(err, IsNil)
+
+	e := input.NewEvent("password accepted for user root", "10.0.0.1:41234")
+	b, err := json.Marshal(input.NewDeadLetter(e, "priority: missing"))
+	c.Assert(err, IsNil)
+	w.Write(string(b))
+	w.Write(string(b))
+	c.Assert(w.Close(), IsNil)
+
+	contents, err := ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+	lines := strings.Split(strings.TrimSuffix(string(contents), "\n"), "\n")
+	c.Assert(lines, HasLen, 2)
+
+	var d input.DeadLetter
+	c.Assert(json.Unmarshal([]byte(lines[0]), &d), IsNil)
+	c.Assert(d.Raw, Equals, "password accepted for user root")
+	c.Assert(d.Source, Equals, "10.0.0.1:41234")
+	c.Assert(d.Received.Equal(e.Received), Equals, true)
+	c.Assert(d.Reason, Equals, "priority: missing")
+
+	c.Assert(w.msgTx.Count(), Equals, int64(2))
+	c.Assert(w.bytesTx.Count(), Equals, int64(2*len(b)))
+	c.Assert(w.msgErr.Count(), Equals, int64(0))
+}
+
+func (s *OutputSuite) Test_FileWriterAppends(c *C) {
+	path := filepath.Join(c.MkDir(), "dead.log")
+	c.Assert(ioutil.WriteFile(path, []byte("first\n"), 0644), IsNil)
+
+	w, err := NewFileWriter(path)
+	c.Assert(err, IsNil)
+	w.Write("second")
+	c.Assert(w.Close(), IsNil)
+
+	contents, err := ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+	c.Assert(string(contents), Equals, "first\nsecond\n")
+}
+
+func (s *OutputSuite) Test_FileWriterFlush(c *C) {
+	path := filepath.Join(c.MkDir(), "dead.log")
+	w, err := NewFileWriter(path)
+	c.Assert(err, IsNil)
+	defer w.Close()
+
+	w.Write("buffered")
+	fi, err := os.Stat(path)
+	c.Assert(err, IsNil)
+	c.Assert(fi.Size(), Equals, int64(0))
+
+	// Buffered messages are written by the periodic flush.
+	deadline := time.Now().Add(5 * fileFlushInterval)
+	for fi.Size() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		fi, err = os.Stat(path)
+		c.Assert(err, IsNil)
+	}
+	c.Assert(fi.Size(), Equals, int64(len("buffered\n")))
+}
+
+func (s *OutputSuite) Test_FileWriterError(c *C) {
+	_, err := NewFileWriter(filepath.Join(c.MkDir(), "missing", "dead.log"))
+	c.Assert(err, NotNil)
+}
@@ -1,6 +1,9 @@
 package output
 
 import (
+	"log"
+	"regexp"
+	"sync"
 	"time"
 
 	"github.com/Shopify/sarama"
@@ -8,17 +11,30 @@ import (
 	metrics "github.com/rcrowley/go-metrics"
 )
 
+// A Route writes messages matching Match to Topic.
+type Route struct {
+	Match *regexp.Regexp
+	Topic string
+}
+
 // A KafkaProducer encapsulates a connection to a Kafka cluster.
 type KafkaProducer struct {
 	producer sarama.AsyncProducer
 	topic    string
+	routes   []Route
 
 	registry metrics.Registry
 	msgTx    metrics.Counter
 	bytesTx  metrics.Counter
+	msgErr   metrics.Counter
+
+	mu        sync.Mutex
+	lastErr   error
+	lastErrAt time.Time
 }
 
-// NewKafkaProducer returns an initialized KafkaProducer.
+// NewKafkaProducer returns an initialized KafkaProducer. Messages are written
+// to topic, unless routed elsewhere.
 func NewKafkaProducer(brokers []string, topic string, bufferTime, bufferBytes, batchSz int) (*KafkaProducer, error) {
 	config := sarama.NewConfig()
 	config.Producer.RequiredAcks = sarama.WaitForLocal     // Only wait for the leader to ack
@@ -37,17 +53,70 @@ func NewKafkaProducer(brokers []string, topic string, bufferTime, bufferBytes, b
 		registry: metrics.NewRegistry(),
 		msgTx:    metrics.NewCounter(),
 		bytesTx:  metrics.NewCounter(),
+		msgErr:   metrics.NewCounter(),
 	}
 
 	k.registry.Register("messages.transmitted", k.msgTx)
 	k.registry.Register("messages.bytes.transmitted", k.bytesTx)
+	k.registry.Register("messages.errors", k.msgErr)
+
+	go k.handleErrors()
 
 	return k, nil
 }
 
+// handleErrors records the errors returned by the producer. The channel
+// must be drained, or the producer will eventually block.
+func (k *KafkaProducer) handleErrors() {
+	for e := range k.producer.Errors() {
+		k.msgErr.Inc(1)
+		k.mu.Lock()
+		if k.lastErr == nil || k.lastErr.Error() != e.Err.Error() {
+			log.Println("failed to write to Kafka:", e.Err)
+		}
+		k.lastErr = e.Err
+		k.lastErrAt = time.Now()
+		k.mu.Unlock()
+	}
+}
+
+// LastError returns when the most recent error was returned by Kafka, and
+// the error. If no error has occurred, the error is nil.
+func (k *KafkaProducer) LastError() (time.Time, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.lastErrAt, k.lastErr
+}
+
+// SetRoutes sets the Routes used to choose the topic for each message. The
+// first Route to match is used, and if none match, the default topic.
+func (k *KafkaProducer) SetRoutes(routes []Route) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.routes = routes
+}
+
+// route returns the topic to which the message should be written.
+func (k *KafkaProducer) route(s string) string {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for _, r := range k.routes {
+		if r.Match.MatchString(s) {
+			return r.Topic
+		}
+	}
+	return k.topic
+}
+
+// Write writes the message to Kafka.
 func (k *KafkaProducer) Write(s string) {
+	k.WriteTo(k.route(s), s)
+}
+
+// WriteTo writes the message to the given Kafka topic, ignoring any Routes.
+func (k *KafkaProducer) WriteTo(topic, s string) {
 	k.producer.Input() <- &sarama.ProducerMessage{
-		Topic: k.topic,
+		Topic: topic,
 		Value: sarama.StringEncoder(s),
 	}
 	k.msgTx.Inc(1)
@@ -0,0 +1,179 @@
+package pipeline
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/otoolep/syslog-gollector/input"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// The field of transformed messages recording how many identical messages
+// they stand for.
+const repeatedField = "repeated"
+
+// A dedupEntry records an Event, and how many identical Events followed it.
+type dedupEntry struct {
+	event *input.Event
+	first time.Time
+	count int64
+}
+
+// A Dedup is a Stage which passes the first of any identical Events within
+// a window, and drops the rest. Once the window has passed, a summary is
+// sent recording how many were dropped, "last message repeated N times".
+// Parsed Events are identical if the named fields are equal, and others if
+// they are equal as received.
+type Dedup struct {
+	mu      sync.Mutex
+	window  time.Duration
+	key     []string
+	entries map[string]*dedupEntry
+	pending []*dedupEntry // Expired, but not yet reported
+
+	registry   metrics.Registry
+	duplicates metrics.Counter
+	repeated   metrics.Counter
+}
+
+// NewDedup returns a Dedup comparing Events by the given fields within the
+// window. If the window is 0, no Events are dropped.
+func NewDedup(window time.Duration, key []string) *Dedup {
+	d := &Dedup{window: window, key: key, entries: make(map[string]*dedupEntry)}
+
+	d.registry = metrics.NewRegistry()
+	d.duplicates = metrics.NewCounter()
+	d.repeated = metrics.NewCounter()
+	d.registry.Register("events.duplicates", d.duplicates)
+	d.registry.Register("events.repeated", d.repeated)
+	return d
+}
+
+// Set replaces the window and fields by which Events are compared. Any
+// duplicates not yet reported are reported at the next Flush.
+func (d *Dedup) Set(window time.Duration, key []string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, e := range d.entries {
+		d.expire(e)
+	}
+	d.window = window
+	d.key = key
+	d.entries = make(map[string]*dedupEntry)
+}
+
+// Process implements Stage.
+func (d *Dedup) Process(e *input.Event) bool {
+	return d.process(e, time.Now())
+}
+
+func (d *Dedup) process(e *input.Event, now time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.window <= 0 {
+		return true
+	}
+
+	k := d.keyOf(e)
+	if entry, ok := d.entries[k]; ok {
+		if now.Sub(entry.first) < d.window {
+			entry.count++
+			d.duplicates.Inc(1)
+			return false
+		}
+		d.expire(entry)
+	}
+	d.entries[k] = &dedupEntry{event: e, first: now}
+	return true
+}
+
+// keyOf returns the key by which the Event is compared.
+func (d *Dedup) keyOf(e *input.Event) string {
+	if e.Parsed == nil {
+		return e.Raw
+	}
+	values := make([]string, len(d.key))
+	for i, name := range d.key {
+		values[i], _ = e.Parsed.Field(name)
+	}
+	// Distinguish parsed from unparsed Events, and separate the values.
+	return "\x00" + strings.Join(values, "\x00")
+}
+
+// expire queues the entry to be reported, if it had duplicates. The entry
+// must already have been removed, or be about to be replaced.
+func (d *Dedup) expire(entry *dedupEntry) {
+	if entry.count > 0 {
+		d.pending = append(d.pending, entry)
+	}
+}
+
+// Start instructs the Dedup to pass an Event to f every interval for each
+// Event whose window has passed and which had duplicates.
+func (d *Dedup) Start(interval time.Duration, f func(*input.Event)) {
+	go func() {
+		for now := range time.Tick(interval) {
+			for _, e := range d.Flush(now) {
+				f(e)
+			}
+		}
+	}()
+}
+
+// Flush returns an Event for each Event whose window has passed as of now
+// and which had duplicates, recording the number of duplicates.
+func (d *Dedup) Flush(now time.Time) []*input.Event {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for k, entry := range d.entries {
+		if now.Sub(entry.first) >= d.window {
+			delete(d.entries, k)
+			d.expire(entry)
+		}
+	}
+
+	events := make([]*input.Event, 0, len(d.pending))
+	for _, entry := range d.pending {
+		events = append(events, repeat(entry.event, entry.count, now))
+	}
+	d.repeated.Inc(int64(len(events)))
+	d.pending = nil
+	return events
+}
+
+// repeat returns a summary of the Event recording that n duplicates of it
+// were dropped. A parsed summary keeps the header of the Event, but its
+// message is replaced, so it is not mistaken for another occurrence.
+// Unparsed Events are reported by a synthetic message.
+func repeat(e *input.Event, n int64, now time.Time) *input.Event {
+	msg := fmt.Sprintf("last message repeated %d times", n)
+	if e.Parsed == nil {
+		return input.NewSyntheticEvent(now, msg+": "+e.Raw)
+	}
+
+	r := input.NewEvent(e.Raw, e.Source)
+	r.Received, r.Listener, r.Protocol = now, e.Listener, e.Protocol
+	parsed := *e.Parsed
+	parsed.Message = msg
+	parsed.Repeated = n
+	r.Parsed = &parsed
+	if e.Fields != nil {
+		r.Fields = make(map[string]interface{}, len(e.Fields)+1)
+		for k, v := range e.Fields {
+			r.Fields[k] = v
+		}
+		r.Fields[input.FieldMessage] = msg
+		r.Fields[repeatedField] = n
+	}
+	return r
+}
+
+// Statistics returns an object storing statistics, which supports JSON
+// marshalling.
+func (d *Dedup) Statistics() (metrics.Registry, error) {
+	return d.registry, nil
+}
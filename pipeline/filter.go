@@ -0,0 +1,123 @@
+package pipeline
+
+import (
+	"regexp"
+	"sync"
+
+	"github.com/otoolep/syslog-gollector/input"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// A FilterRule matches an Event if every regular expression in Fields
+// matches the named field of the parsed message, and Raw, if set, matches
+// the message as received. A rule with no expressions matches every Event.
+type FilterRule struct {
+	Name    string
+	Exclude bool // Drop matching Events, rather than keep them
+	Fields  map[string]*regexp.Regexp
+	Raw     *regexp.Regexp
+}
+
+// matches returns whether the rule matches the Event. Field expressions
+// never match an Event which has not been parsed.
+func (r *FilterRule) matches(e *input.Event) bool {
+	if r.Raw != nil && !r.Raw.MatchString(e.Raw) {
+		return false
+	}
+	return matchFields(r.Fields, e)
+}
+
+// matchFields returns whether every regular expression matches the named
+// field of the parsed message. They never match an Event which has not been
+// parsed.
+func matchFields(fields map[string]*regexp.Regexp, e *input.Event) bool {
+	if len(fields) > 0 && e.Parsed == nil {
+		return false
+	}
+	for name, re := range fields {
+		v, _ := e.Parsed.Field(name)
+		if !re.MatchString(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// A Filter is a Stage which keeps or drops Events according to the first
+// FilterRule which matches. If no rule matches, the Event is kept, unless
+// there are any rules which keep Events, in which case only Events matching
+// one of those are kept.
+type Filter struct {
+	mu       sync.RWMutex
+	rules    []FilterRule
+	hits     []metrics.Counter
+	includes bool
+
+	registry metrics.Registry
+	passed   metrics.Counter
+	dropped  metrics.Counter
+}
+
+// NewFilter returns a Filter applying the given rules.
+func NewFilter(rules []FilterRule) *Filter {
+	f := &Filter{}
+
+	f.registry = metrics.NewRegistry()
+	f.passed = metrics.NewCounter()
+	f.dropped = metrics.NewCounter()
+	f.registry.Register("events.passed", f.passed)
+	f.registry.Register("events.dropped", f.dropped)
+
+	f.SetRules(rules)
+	return f
+}
+
+// SetRules replaces the rules applied by the Filter. The hit counters of
+// the rules are reset.
+func (f *Filter) SetRules(rules []FilterRule) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, r := range f.rules {
+		f.registry.Unregister("rules." + r.Name + ".hits")
+	}
+	f.rules = rules
+	f.hits = make([]metrics.Counter, len(rules))
+	f.includes = false
+	for i, r := range rules {
+		f.hits[i] = metrics.NewCounter()
+		f.registry.Register("rules."+r.Name+".hits", f.hits[i])
+		if !r.Exclude {
+			f.includes = true
+		}
+	}
+}
+
+// Process implements Stage.
+func (f *Filter) Process(e *input.Event) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	keep := !f.includes
+	for i := range f.rules {
+		if f.rules[i].matches(e) {
+			f.hits[i].Inc(1)
+			keep = !f.rules[i].Exclude
+			break
+		}
+	}
+
+	if keep {
+		f.passed.Inc(1)
+	} else {
+		f.dropped.Inc(1)
+	}
+	return keep
+}
+
+// Statistics returns an object storing statistics, which supports JSON
+// marshalling.
+func (f *Filter) Statistics() (metrics.Registry, error) {
+	return f.registry, nil
+}
@@ -0,0 +1,33 @@
+// Package pipeline provides the stages through which Events pass between the
+// parser and the output.
+package pipeline
+
+import (
+	"github.com/otoolep/syslog-gollector/input"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// A Stage processes Events before they are written. Stages must be safe for
+// use by multiple goroutines.
+type Stage interface {
+	// Process processes the Event, returning false if it is to be dropped.
+	Process(e *input.Event) bool
+
+	// Statistics returns an object storing statistics, which supports JSON
+	// marshalling.
+	Statistics() (metrics.Registry, error)
+}
+
+// Sink returns a function which passes each Event through the stages in
+// order, and then to f, unless a stage drops it.
+func Sink(f func(*input.Event), stages ...Stage) func(*input.Event) {
+	return func(e *input.Event) {
+		for _, s := range stages {
+			if !s.Process(e) {
+				return
+			}
+		}
+		f(e)
+	}
+}
@@ -0,0 +1,373 @@
+package pipeline
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/otoolep/syslog-gollector/input"
+	metrics "github.com/rcrowley/go-metrics"
+
+	. "gopkg.in/check.v1"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+type PipelineSuite struct{}
+
+var _ = Suite(&PipelineSuite{})
+
+// parsed returns a parsed Event for the raw message.
+func parsed(c *C, raw string) *input.Event {
+	e := input.NewEvent(raw, "10.0.0.1:514")
+	m, err := input.NewRfc5424Parser().Parse(raw)
+	c.Assert(err, IsNil)
+	e.Parsed = m
+	return e
+}
+
+func (s *PipelineSuite) Test_Sink(c *C) {
+	var out []string
+	f := NewFilter([]FilterRule{{Name: "noise", Exclude: true, Raw: regexp.MustCompile("noise")}})
+	sink := Sink(func(e *input.Event) { out = append(out, e.Raw) }, f)
+
+	sink(input.NewEvent("signal", ""))
+	sink(input.NewEvent("noise", ""))
+	c.Assert(out, DeepEquals, []string{"signal"})
+}
+
+func (s *PipelineSuite) Test_FilterExclude(c *C) {
+	f := NewFilter([]FilterRule{
+		{Name: "systemd-debug", Exclude: true, Fields: map[string]*regexp.Regexp{
+			"app":           regexp.MustCompile("^(?:systemd)$"),
+			"severity_name": regexp.MustCompile("^(?:debug)$"),
+		}},
+		{Name: "heartbeat", Exclude: true, Raw: regexp.MustCompile("heartbeat")},
+	})
+
+	c.Assert(f.Process(parsed(c, "<135>1 - ubuntu systemd 1 - started")), Equals, false)
+	c.Assert(f.Process(parsed(c, "<134>1 - ubuntu systemd 1 - started")), Equals, true)
+	c.Assert(f.Process(parsed(c, "<135>1 - ubuntu sshd 1 - started")), Equals, true)
+	c.Assert(f.Process(parsed(c, "<134>1 - ubuntu sshd 1 - heartbeat")), Equals, false)
+	c.Assert(f.Process(input.NewEvent("heartbeat", "")), Equals, false)
+	c.Assert(f.Process(input.NewEvent("systemd", "")), Equals, true)
+
+	c.Assert(f.registry.Get("rules.systemd-debug.hits").(metrics.Counter).Count(), Equals, int64(1))
+	c.Assert(f.registry.Get("rules.heartbeat.hits").(metrics.Counter).Count(), Equals, int64(2))
+	c.Assert(f.passed.Count(), Equals, int64(3))
+	c.Assert(f.dropped.Count(), Equals, int64(3))
+}
+
+func (s *PipelineSuite) Test_FilterInclude(c *C) {
+	f := NewFilter([]FilterRule{
+		{Name: "sshd-debug", Exclude: true, Fields: map[string]*regexp.Regexp{"severity_name": regexp.MustCompile("^(?:debug)$")}},
+		{Name: "sshd", Fields: map[string]*regexp.Regexp{"app": regexp.MustCompile("^(?:sshd)$")}},
+	})
+
+	c.Assert(f.Process(parsed(c, "<134>1 - ubuntu sshd 1 - accepted")), Equals, true)
+	c.Assert(f.Process(parsed(c, "<135>1 - ubuntu sshd 1 - accepted")), Equals, false)
+	c.Assert(f.Process(parsed(c, "<134>1 - ubuntu cron 1 - accepted")), Equals, false)
+
+	// Replacing the rules resets their counters.
+	f.SetRules(nil)
+	c.Assert(f.Process(parsed(c, "<134>1 - ubuntu cron 1 - accepted")), Equals, true)
+	c.Assert(f.registry.Get("rules.sshd.hits"), IsNil)
+}
+
+func (s *PipelineSuite) Test_Transform(c *C) {
+	x := NewTransformer(Transform{
+		KeyValue: true,
+		Patterns: []*regexp.Regexp{regexp.MustCompile(`from (?P<client>\S+) port (?P<port>\d+)`)},
+		Rename:   map[string]string{"host": "hostname"},
+		Add:      map[string]string{"datacenter": "dc1", "env": "prod"},
+		Drop:     []string{"version", "msgid"},
+	})
+	e := parsed(c, `<134>1 2013-09-04T10:25:52Z ubuntu sshd 1999 - accepted from 10.0.0.9 port 22 user=root method="public key" host=ignored`)
+	c.Assert(x.Process(e), Equals, true)
+
+	c.Assert(e.Fields["hostname"], Equals, "ubuntu")
+	c.Assert(e.Fields["datacenter"], Equals, "dc1")
+	c.Assert(e.Fields["env"], Equals, "prod")
+	c.Assert(e.Fields["user"], Equals, "root")
+	c.Assert(e.Fields["method"], Equals, "public key")
+	c.Assert(e.Fields["client"], Equals, "10.0.0.9")
+	c.Assert(e.Fields["port"], Equals, "22")
+	c.Assert(e.Fields["pid"], Equals, json.Number("1999"))
+	for _, k := range []string{"host", "version", "msgid"} {
+		_, ok := e.Fields[k]
+		c.Assert(ok, Equals, false, Commentf(k))
+	}
+	c.Assert(x.extracted.Count(), Equals, int64(4))
+
+	b, err := e.Encode()
+	c.Assert(err, IsNil)
+	c.Assert(strings.Contains(string(b), `"pid":1999`), Equals, true)
+	c.Assert(strings.Contains(string(b), `"env":"prod"`), Equals, true)
+}
+
+func (s *PipelineSuite) Test_TransformUnparsed(c *C) {
+	x := NewTransformer(Transform{Add: map[string]string{"env": "prod"}})
+	e := input.NewEvent("password accepted", "")
+	c.Assert(x.Process(e), Equals, true)
+	c.Assert(e.Fields, IsNil)
+
+	b, err := e.Encode()
+	c.Assert(err, IsNil)
+	c.Assert(string(b), Equals, "password accepted")
+}
+
+func (s *PipelineSuite) Test_Luhn(c *C) {
+	c.Assert(luhn("4111 1111 1111 1111"), Equals, true)
+	c.Assert(luhn("4111-1111-1111-1111"), Equals, true)
+	c.Assert(luhn("4111 1111 1111 1112"), Equals, false)
+	c.Assert(luhn("4111"), Equals, false)
+}
+
+func (s *PipelineSuite) Test_Redact(c *C) {
+	card, _ := Builtin("credit_card")
+	bearer, _ := Builtin("bearer_token")
+	email, _ := Builtin("email")
+	email.Hash = true
+	email.Key = []byte("key")
+	r := NewRedactor([]RedactRule{card, bearer, email,
+		{Name: "password", Match: regexp.MustCompile(`password=(\S+)`)}})
+
+	e := parsed(c, "<134>1 - ubuntu app 1 - card 4111 1111 1111 1111 order 1234567890123 "+
+		"Authorization: Bearer abc.def-123 from jo@example.com password=hunter2")
+	r.Process(e)
+
+	mac := hmac.New(sha256.New, []byte("key"))
+	mac.Write([]byte("jo@example.com"))
+	expected := "card [REDACTED] order 1234567890123 Authorization: Bearer [REDACTED] from [hmac:" +
+		hex.EncodeToString(mac.Sum(nil))[:16] + "] password=[REDACTED]"
+	c.Assert(e.Parsed.Message, Equals, expected)
+	c.Assert(strings.HasSuffix(e.Raw, expected), Equals, true)
+
+	for _, name := range []string{"credit_card", "bearer_token", "email", "password"} {
+		c.Assert(r.registry.Get("rules."+name+".redactions").(metrics.Counter).Count(), Equals, int64(1), Commentf(name))
+	}
+	c.Assert(r.redacted.Count(), Equals, int64(1))
+
+	r.Process(input.NewEvent("nothing to see", ""))
+	c.Assert(r.redacted.Count(), Equals, int64(1))
+}
+
+func (s *PipelineSuite) Test_RedactKey(c *C) {
+	email, _ := Builtin("email")
+	email.Hash = true
+	email.Key = []byte("one")
+	one, _ := email.redact("from jo@example.com")
+	again, _ := email.redact("from jo@example.com")
+	email.Key = []byte("two")
+	two, _ := email.redact("from jo@example.com")
+
+	c.Assert(one, Equals, again)
+	c.Assert(one, Not(Equals), two)
+	c.Assert(strings.Contains(one, "jo@example.com"), Equals, false)
+}
+
+func (s *PipelineSuite) Test_RedactUnparsed(c *C) {
+	r := NewRedactor([]RedactRule{{Name: "password", Match: regexp.MustCompile(`password=(\S+)`)}})
+	p := input.NewRfc5424Parser()
+	p.SetRedact(func(e *input.Event) { r.Process(e) })
+	dead := make(chan *input.Event, 1)
+	p.SetDeadLetter(func(e *input.Event, reason string) { dead <- e })
+
+	in := make(chan *input.Event)
+	p.StreamingParse(in, 1, false, func(e *input.Event) { c.Error("parsed unparseable message") })
+	in <- input.NewEvent("login failed password=hunter2", "")
+	close(in)
+
+	select {
+	case e := <-dead:
+		c.Assert(e.Raw, Equals, "login failed password=[REDACTED]")
+	case <-time.After(5 * time.Second):
+		c.Fatal("message not dead-lettered")
+	}
+	failures := p.Failures().Recent()
+	c.Assert(failures, HasLen, 1)
+	c.Assert(failures[0].Raw, Equals, "login failed password=[REDACTED]")
+}
+
+func (s *PipelineSuite) Test_RateLimitStages(c *C) {
+	l := NewRateLimiter([]RateRule{
+		{Name: "peer", By: ByPeer, Rate: 0, Burst: 1, Action: LimitDrop},
+		{Name: "host", By: ByHost, Rate: 0, Burst: 1, Action: LimitDrop},
+	})
+	peers, hosts := l.Peers(), l.Parsed()
+
+	// Before parsing, only the peer rule applies.
+	e := input.NewEvent("<134>1 - ubuntu app 1 - hello", "10.0.0.1:514")
+	c.Assert(peers.Process(e), Equals, true)
+	c.Assert(peers.Process(e), Equals, false)
+	c.Assert(hosts.Process(parsed(c, "<134>1 - ubuntu app 1 - hello")), Equals, true)
+	c.Assert(hosts.Process(parsed(c, "<134>1 - ubuntu app 1 - hello")), Equals, false)
+	c.Assert(peers.Process(input.NewEvent("hello", "10.0.0.2:514")), Equals, true)
+	c.Assert(l.registry.Get("rules.peer.suppressed").(metrics.Counter).Count(), Equals, int64(1))
+	c.Assert(l.registry.Get("rules.host.suppressed").(metrics.Counter).Count(), Equals, int64(1))
+}
+
+func (s *PipelineSuite) Test_RateLimitPeer(c *C) {
+	_, n, _ := net.ParseCIDR("10.0.0.0/8")
+	l := NewRateLimiter([]RateRule{{Name: "lan", By: ByPeer, Nets: []*net.IPNet{n}, Rate: 1, Burst: 2, Action: LimitSummary}})
+	now := time.Now()
+
+	e := input.NewEvent("a", "10.0.0.1:514")
+	c.Assert(l.process(e, now), Equals, true)
+	c.Assert(l.process(e, now), Equals, true)
+	c.Assert(l.process(e, now), Equals, false)
+	c.Assert(l.process(e, now), Equals, false)
+
+	// Other senders have their own limit, and senders outside the network
+	// and the program itself are not limited.
+	c.Assert(l.process(input.NewEvent("a", "10.0.0.2:514"), now), Equals, true)
+	for i := 0; i < 5; i++ {
+		c.Assert(l.process(input.NewEvent("a", "192.168.0.1:514"), now), Equals, true)
+		c.Assert(l.process(input.NewEvent("a", ""), now), Equals, true)
+	}
+
+	// The bucket refills at the rate.
+	c.Assert(l.process(e, now.Add(time.Second)), Equals, true)
+	c.Assert(l.process(e, now.Add(time.Second)), Equals, false)
+
+	c.Assert(l.suppressedTotal.Count(), Equals, int64(3))
+	c.Assert(l.Summarize(now.Add(time.Second)), DeepEquals, []string{"3 messages suppressed from peer 10.0.0.1 by rate limit lan"})
+	c.Assert(l.Summarize(now.Add(time.Second)), HasLen, 0)
+
+	// Once refilled, buckets are forgotten.
+	l.Summarize(now.Add(time.Minute))
+	c.Assert(l.buckets[0], HasLen, 0)
+}
+
+func (s *PipelineSuite) Test_RateLimitSample(c *C) {
+	l := NewRateLimiter([]RateRule{{Name: "app", By: ByApp, Rate: 1, Burst: 1, Action: LimitSample, Sample: 3}})
+	now := time.Now()
+	e := parsed(c, "<134>1 - ubuntu sshd 1 - accepted")
+
+	var kept []bool
+	for i := 0; i < 7; i++ {
+		kept = append(kept, l.process(e, now))
+	}
+	c.Assert(kept, DeepEquals, []bool{true, true, false, false, true, false, false})
+	c.Assert(l.Summarize(now), HasLen, 0)
+
+	// Unparsed messages have no app, so are not limited.
+	c.Assert(l.process(input.NewEvent("a", "10.0.0.1:514"), now), Equals, true)
+}
+
+func (s *PipelineSuite) Test_ParseLimitAction(c *C) {
+	for _, name := range []string{"drop", "sample", "summary"} {
+		a, err := ParseLimitAction(name)
+		c.Assert(err, IsNil)
+		c.Assert(a.String(), Equals, name)
+	}
+	_, err := ParseLimitAction("block")
+	c.Assert(err, NotNil)
+}
+
+func (s *PipelineSuite) Test_Dedup(c *C) {
+	d := NewDedup(10*time.Second, []string{"host", "app", "message"})
+	now := time.Now()
+
+	first := parsed(c, "<134>1 - ubuntu sshd 1 - connection reset")
+	c.Assert(d.process(first, now), Equals, true)
+	for i := 1; i <= 3; i++ {
+		c.Assert(d.process(parsed(c, fmt.Sprintf("<134>1 - ubuntu sshd %d - connection reset", i+1)), now.Add(time.Second)), Equals, false)
+	}
+	c.Assert(d.process(parsed(c, "<134>1 - ubuntu cron 1 - connection reset"), now), Equals, true)
+	c.Assert(d.process(input.NewEvent("connection reset", ""), now), Equals, true)
+	c.Assert(d.process(input.NewEvent("connection reset", ""), now), Equals, false)
+	c.Assert(d.duplicates.Count(), Equals, int64(4))
+
+	c.Assert(d.Flush(now.Add(5*time.Second)), HasLen, 0)
+	repeats := d.Flush(now.Add(10 * time.Second))
+	c.Assert(repeats, HasLen, 2)
+	for _, r := range repeats {
+		if r.Parsed != nil {
+			c.Assert(r.Parsed.Repeated, Equals, int64(3))
+			c.Assert(r.Parsed.App, Equals, "sshd")
+			c.Assert(r.Parsed.Message, Equals, "last message repeated 3 times")
+			c.Assert(first.Parsed.Repeated, Equals, int64(0))
+			c.Assert(first.Parsed.Message, Equals, "connection reset")
+		} else {
+			c.Assert(strings.HasSuffix(r.Raw, " - last message repeated 1 times: connection reset"), Equals, true)
+		}
+	}
+
+	// The window has passed, so the message is passed again.
+	c.Assert(d.process(parsed(c, "<134>1 - ubuntu sshd 1 - connection reset"), now.Add(10*time.Second)), Equals, true)
+	c.Assert(d.Flush(now.Add(20*time.Second)), HasLen, 0)
+}
+
+func (s *PipelineSuite) Test_DedupTransformed(c *C) {
+	d := NewDedup(time.Second, []string{"message"})
+	now := time.Now()
+
+	e := parsed(c, "<134>1 - ubuntu sshd 1 - connection reset")
+	e.Fields = map[string]interface{}{"message": "connection reset"}
+	c.Assert(d.process(e, now), Equals, true)
+	c.Assert(d.process(e, now), Equals, false)
+
+	repeats := d.Flush(now.Add(time.Second))
+	c.Assert(repeats, HasLen, 1)
+	c.Assert(repeats[0].Fields[repeatedField], Equals, int64(1))
+	c.Assert(repeats[0].Fields["message"], Equals, "last message repeated 1 times")
+	_, ok := e.Fields[repeatedField]
+	c.Assert(ok, Equals, false)
+}
+
+func (s *PipelineSuite) Test_SampleEvery(c *C) {
+	sm := NewSampler([]SampleRule{{Name: "debug", Every: 3, Fields: map[string]*regexp.Regexp{"severity_name": regexp.MustCompile("^(?:debug)$")}}})
+
+	var kept []bool
+	for i := 0; i < 7; i++ {
+		e := parsed(c, "<135>1 - ubuntu app 1 - verbose")
+		kept = append(kept, sm.Process(e))
+		if kept[i] {
+			c.Assert(e.Parsed.SampleRate, Equals, float64(3))
+		}
+	}
+	c.Assert(kept, DeepEquals, []bool{true, false, false, true, false, false, true})
+
+	e := parsed(c, "<134>1 - ubuntu app 1 - info")
+	c.Assert(sm.Process(e), Equals, true)
+	c.Assert(e.Parsed.SampleRate, Equals, float64(0))
+	c.Assert(sm.Process(input.NewEvent("debug", "")), Equals, true)
+
+	c.Assert(sm.registry.Get("rules.debug.kept").(metrics.Counter).Count(), Equals, int64(3))
+	c.Assert(sm.droppedTotal.Count(), Equals, int64(4))
+
+	b, err := parsed(c, "<135>1 - ubuntu app 1 - verbose").Encode()
+	c.Assert(err, IsNil)
+	c.Assert(strings.Contains(string(b), "sample_rate"), Equals, false)
+}
+
+func (s *PipelineSuite) Test_SamplePercent(c *C) {
+	sm := NewSampler([]SampleRule{{Name: "all", Percent: 25}})
+	values := []float64{0.1, 0.3, 0.24, 0.9}
+	sm.random = func() float64 {
+		v := values[0]
+		values = values[1:]
+		return v
+	}
+
+	var kept []bool
+	for i := 0; i < 4; i++ {
+		e := parsed(c, "<134>1 - ubuntu app 1 - info")
+		kept = append(kept, sm.Process(e))
+		if kept[i] {
+			c.Assert(e.Parsed.SampleRate, Equals, float64(4))
+		}
+	}
+	c.Assert(kept, DeepEquals, []bool{true, false, true, false})
+}
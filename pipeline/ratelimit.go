@@ -0,0 +1,299 @@
+package pipeline
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/otoolep/syslog-gollector/input"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// A LimitAction determines what a RateLimiter does with messages over the
+// limit.
+type LimitAction int
+
+const (
+	// LimitDrop drops the message.
+	LimitDrop LimitAction = iota
+	// LimitSample keeps one in every Sample messages, and drops the rest.
+	LimitSample
+	// LimitSummary drops the message, and periodically reports how many
+	// were dropped.
+	LimitSummary
+)
+
+var limitActionNames = map[LimitAction]string{
+	LimitDrop:    "drop",
+	LimitSample:  "sample",
+	LimitSummary: "summary",
+}
+
+// ParseLimitAction returns the LimitAction with the given name.
+func ParseLimitAction(name string) (LimitAction, error) {
+	for a, n := range limitActionNames {
+		if n == name {
+			return a, nil
+		}
+	}
+	return LimitDrop, fmt.Errorf("unknown action %q, must be one of drop, sample or summary", name)
+}
+
+// String returns the name of the LimitAction.
+func (a LimitAction) String() string {
+	return limitActionNames[a]
+}
+
+// What messages are counted together by a RateRule.
+const (
+	ByPeer = "peer" // The IP address of the sender
+	ByHost = "host" // The host of the parsed message
+	ByApp  = "app"  // The app of the parsed message
+)
+
+// A RateRule limits the rate of messages from each sender, host or app, as
+// determined by By, to Rate messages per second, with bursts of up to Burst
+// messages. If Nets is set, the rule only applies to messages from senders
+// in one of the networks.
+type RateRule struct {
+	Name   string
+	By     string
+	Nets   []*net.IPNet
+	Rate   float64
+	Burst  int
+	Action LimitAction
+	Sample int
+}
+
+// matches returns whether the rule applies to the Event, and if so the key
+// of the bucket counting it.
+func (r *RateRule) matches(e *input.Event) (string, bool) {
+	host, _, err := net.SplitHostPort(e.Source)
+	if err != nil {
+		host = e.Source
+	}
+	if len(r.Nets) > 0 {
+		ip := net.ParseIP(host)
+		if ip == nil || !contains(r.Nets, ip) {
+			return "", false
+		}
+	}
+
+	switch r.By {
+	case ByPeer:
+		return host, host != ""
+	case ByHost:
+		if e.Parsed != nil {
+			return e.Parsed.Host, true
+		}
+	case ByApp:
+		if e.Parsed != nil {
+			return e.Parsed.App, true
+		}
+	}
+	return "", false
+}
+
+func contains(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// A bucket is a token bucket, holding up to a rule's Burst tokens.
+type bucket struct {
+	tokens     float64
+	last       time.Time
+	over       int64 // Messages over the limit, for sampling
+	suppressed int64 // Messages suppressed since the last summary
+}
+
+// take refills the bucket as of now, and takes a token if there is one.
+func (b *bucket) take(r *RateRule, now time.Time) bool {
+	b.refill(r, now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (b *bucket) refill(r *RateRule, now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * r.Rate
+	if b.tokens > float64(r.Burst) {
+		b.tokens = float64(r.Burst)
+	}
+	b.last = now
+}
+
+// A RateLimiter is a Stage which limits the rate of messages according to
+// the first RateRule which applies to each. Messages generated by the
+// program itself are never limited by sender.
+type RateLimiter struct {
+	mu         sync.Mutex
+	rules      []RateRule
+	buckets    []map[string]*bucket
+	suppressed []metrics.Counter
+
+	registry        metrics.Registry
+	suppressedTotal metrics.Counter
+}
+
+// NewRateLimiter returns a RateLimiter applying the given rules.
+func NewRateLimiter(rules []RateRule) *RateLimiter {
+	l := &RateLimiter{}
+
+	l.registry = metrics.NewRegistry()
+	l.suppressedTotal = metrics.NewCounter()
+	l.registry.Register("events.suppressed", l.suppressedTotal)
+
+	l.SetRules(rules)
+	return l
+}
+
+// SetRules replaces the rules applied by the RateLimiter. All rate limits,
+// and the counters of the rules, are reset.
+func (l *RateLimiter) SetRules(rules []RateRule) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, r := range l.rules {
+		l.registry.Unregister("rules." + r.Name + ".suppressed")
+	}
+	l.rules = rules
+	l.buckets = make([]map[string]*bucket, len(rules))
+	l.suppressed = make([]metrics.Counter, len(rules))
+	for i, r := range rules {
+		l.buckets[i] = make(map[string]*bucket)
+		l.suppressed[i] = metrics.NewCounter()
+		l.registry.Register("rules."+r.Name+".suppressed", l.suppressed[i])
+	}
+}
+
+// Process implements Stage.
+func (l *RateLimiter) Process(e *input.Event) bool {
+	return l.process(e, time.Now())
+}
+
+// Peers returns a Stage applying only the rules By peer. These need only
+// the sender's address, so the Stage may run before messages are parsed,
+// stopping a flooding sender before it fills the channels shared with
+// everyone else.
+func (l *RateLimiter) Peers() Stage {
+	return &rateStage{l: l, peer: true}
+}
+
+// Parsed returns a Stage applying only the rules by host or app, which
+// need parsed messages.
+func (l *RateLimiter) Parsed() Stage {
+	return &rateStage{l: l, peer: false}
+}
+
+// A rateStage is a Stage applying the rules of a RateLimiter By peer, or
+// those which are not.
+type rateStage struct {
+	l    *RateLimiter
+	peer bool
+}
+
+// Process implements Stage.
+func (s *rateStage) Process(e *input.Event) bool {
+	return s.l.processRules(e, time.Now(), func(r *RateRule) bool {
+		return (r.By == ByPeer) == s.peer
+	})
+}
+
+// Statistics returns the statistics of the RateLimiter.
+func (s *rateStage) Statistics() (metrics.Registry, error) {
+	return s.l.Statistics()
+}
+
+func (l *RateLimiter) process(e *input.Event, now time.Time) bool {
+	return l.processRules(e, now, nil)
+}
+
+// processRules applies the first rule which applies to the Event, of those
+// for which only returns true, or of all rules if only is nil.
+func (l *RateLimiter) processRules(e *input.Event, now time.Time, only func(*RateRule) bool) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for i := range l.rules {
+		r := &l.rules[i]
+		if only != nil && !only(r) {
+			continue
+		}
+		key, ok := r.matches(e)
+		if !ok {
+			continue
+		}
+
+		b, ok := l.buckets[i][key]
+		if !ok {
+			b = &bucket{tokens: float64(r.Burst), last: now}
+			l.buckets[i][key] = b
+		}
+		if b.take(r, now) {
+			return true
+		}
+		b.over++
+		if r.Action == LimitSample && (b.over-1)%int64(r.Sample) == 0 {
+			return true
+		}
+		b.suppressed++
+		l.suppressed[i].Inc(1)
+		l.suppressedTotal.Inc(1)
+		return false
+	}
+	return true
+}
+
+// Start instructs the RateLimiter to report the messages suppressed by
+// summary rules every interval, as synthetic Syslog events passed to f. It
+// also forgets senders, hosts and apps which are no longer limited.
+func (l *RateLimiter) Start(interval time.Duration, f func(*input.Event)) {
+	go func() {
+		for now := range time.Tick(interval) {
+			for _, s := range l.Summarize(now) {
+				f(input.NewSyntheticEvent(now, s))
+			}
+		}
+	}()
+}
+
+// Summarize returns a message for each sender, host or app for which summary
+// rules suppressed messages since the last call, sorted, and forgets those
+// whose buckets have refilled as of now.
+func (l *RateLimiter) Summarize(now time.Time) []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var summaries []string
+	for i := range l.rules {
+		r := &l.rules[i]
+		for key, b := range l.buckets[i] {
+			if b.suppressed > 0 && r.Action == LimitSummary {
+				summaries = append(summaries, fmt.Sprintf("%d messages suppressed from %s %s by rate limit %s",
+					b.suppressed, r.By, key, r.Name))
+			}
+			b.suppressed = 0
+			if b.refill(r, now); b.tokens >= float64(r.Burst) {
+				delete(l.buckets[i], key)
+			}
+		}
+	}
+	sort.Strings(summaries)
+	return summaries
+}
+
+// Statistics returns an object storing statistics, which supports JSON
+// marshalling.
+func (l *RateLimiter) Statistics() (metrics.Registry, error) {
+	return l.registry, nil
+}
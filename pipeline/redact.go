@@ -0,0 +1,190 @@
+package pipeline
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/otoolep/syslog-gollector/input"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+const (
+	// What a masked match is replaced with.
+	mask = "[REDACTED]"
+
+	// The number of hex digits of the HMAC kept when hashing a match.
+	hashLen = 16
+)
+
+// builtins are the detectors which may be used by name.
+var builtins = map[string]RedactRule{
+	"credit_card":  {Match: regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`), Check: luhn},
+	"bearer_token": {Match: regexp.MustCompile(`(?i)\bbearer\s+([A-Za-z0-9\-._~+/]+=*)`)},
+	"email":        {Match: regexp.MustCompile(`\b[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}\b`)},
+}
+
+// Builtin returns the RedactRule for the named built-in detector --
+// "credit_card", "bearer_token" or "email" -- and whether there is one.
+func Builtin(name string) (RedactRule, bool) {
+	r, ok := builtins[name]
+	r.Name = name
+	return r, ok
+}
+
+// A RedactRule replaces text matching Match. If Match has any groups, only
+// the text matching the first group is replaced. If Check is set, only text
+// for which it returns true is replaced. Text is replaced by a mask, or if
+// Hash is set, by a prefix of its HMAC-SHA256 keyed by Key, so that equal
+// values may still be correlated but not recovered without the key.
+type RedactRule struct {
+	Name  string
+	Match *regexp.Regexp
+	Check func(s string) bool
+	Hash  bool
+	Key   []byte
+}
+
+// redact returns s with the text matching the rule replaced, and the number
+// of replacements.
+func (r *RedactRule) redact(s string) (string, int) {
+	matches := r.Match.FindAllStringSubmatchIndex(s, -1)
+	if matches == nil {
+		return s, 0
+	}
+
+	var b strings.Builder
+	n, last := 0, 0
+	for _, m := range matches {
+		start, end := m[0], m[1]
+		if len(m) > 2 {
+			if m[2] < 0 {
+				continue
+			}
+			start, end = m[2], m[3]
+		}
+		if r.Check != nil && !r.Check(s[start:end]) {
+			continue
+		}
+		b.WriteString(s[last:start])
+		b.WriteString(r.replacement(s[start:end]))
+		last = end
+		n++
+	}
+	b.WriteString(s[last:])
+	return b.String(), n
+}
+
+// replacement returns the text which replaces s.
+func (r *RedactRule) replacement(s string) string {
+	if !r.Hash {
+		return mask
+	}
+	mac := hmac.New(sha256.New, r.Key)
+	mac.Write([]byte(s))
+	return "[hmac:" + hex.EncodeToString(mac.Sum(nil))[:hashLen] + "]"
+}
+
+// luhn returns whether the digits in s, ignoring spaces and dashes, are a
+// card number which passes the Luhn check.
+func luhn(s string) bool {
+	var digits []int
+	for _, c := range s {
+		switch {
+		case c >= '0' && c <= '9':
+			digits = append(digits, int(c-'0'))
+		case c != ' ' && c != '-':
+			return false
+		}
+	}
+	if len(digits) < 13 || len(digits) > 19 {
+		return false
+	}
+
+	sum := 0
+	for i := range digits {
+		d := digits[len(digits)-1-i]
+		if i%2 == 1 {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return sum%10 == 0
+}
+
+// A Redactor is a Stage which applies RedactRules, in order, to the message
+// as received and to the message of the parsed Event.
+type Redactor struct {
+	mu    sync.RWMutex
+	rules []RedactRule
+	hits  []metrics.Counter
+
+	registry metrics.Registry
+	redacted metrics.Counter
+}
+
+// NewRedactor returns a Redactor applying the given rules.
+func NewRedactor(rules []RedactRule) *Redactor {
+	r := &Redactor{}
+
+	r.registry = metrics.NewRegistry()
+	r.redacted = metrics.NewCounter()
+	r.registry.Register("events.redacted", r.redacted)
+
+	r.SetRules(rules)
+	return r
+}
+
+// SetRules replaces the rules applied by the Redactor. The counters of the
+// rules are reset.
+func (r *Redactor) SetRules(rules []RedactRule) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, rule := range r.rules {
+		r.registry.Unregister("rules." + rule.Name + ".redactions")
+	}
+	r.rules = rules
+	r.hits = make([]metrics.Counter, len(rules))
+	for i, rule := range rules {
+		r.hits[i] = metrics.NewCounter()
+		r.registry.Register("rules."+rule.Name+".redactions", r.hits[i])
+	}
+}
+
+// Process implements Stage. Redactions are counted in the message as
+// written -- the parsed message if there is one, otherwise the message as
+// received.
+func (r *Redactor) Process(e *input.Event) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	redacted := false
+	for i := range r.rules {
+		var n int
+		e.Raw, n = r.rules[i].redact(e.Raw)
+		if e.Parsed != nil {
+			e.Parsed.Message, n = r.rules[i].redact(e.Parsed.Message)
+		}
+		if n > 0 {
+			r.hits[i].Inc(int64(n))
+			redacted = true
+		}
+	}
+	if redacted {
+		r.redacted.Inc(1)
+	}
+	return true
+}
+
+// Statistics returns an object storing statistics, which supports JSON
+// marshalling.
+func (r *Redactor) Statistics() (metrics.Registry, error) {
+	return r.registry, nil
+}
@@ -0,0 +1,117 @@
+package pipeline
+
+import (
+	"math/rand"
+	"regexp"
+	"sync"
+
+	"github.com/otoolep/syslog-gollector/input"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// A SampleRule keeps a sample of the parsed Events for which every regular
+// expression in Fields matches the named field -- either one in every Every
+// Events, or if Every is 0, each Event with a probability of Percent%.
+type SampleRule struct {
+	Name    string
+	Fields  map[string]*regexp.Regexp
+	Every   int
+	Percent float64
+}
+
+// rate returns the number of Events each kept Event stands for.
+func (r *SampleRule) rate() float64 {
+	if r.Every > 0 {
+		return float64(r.Every)
+	}
+	return 100 / r.Percent
+}
+
+// A Sampler is a Stage which samples parsed Events according to the first
+// SampleRule which matches each, recording the sample rate in each Event
+// kept. Events which are not parsed, or which match no rule, are all kept.
+type Sampler struct {
+	mu      sync.Mutex
+	rules   []SampleRule
+	seen    []int64
+	kept    []metrics.Counter
+	dropped []metrics.Counter
+	random  func() float64 // In [0, 1)
+
+	registry     metrics.Registry
+	droppedTotal metrics.Counter
+}
+
+// NewSampler returns a Sampler applying the given rules.
+func NewSampler(rules []SampleRule) *Sampler {
+	s := &Sampler{random: rand.Float64}
+
+	s.registry = metrics.NewRegistry()
+	s.droppedTotal = metrics.NewCounter()
+	s.registry.Register("events.dropped", s.droppedTotal)
+
+	s.SetRules(rules)
+	return s
+}
+
+// SetRules replaces the rules applied by the Sampler. The counters of the
+// rules are reset.
+func (s *Sampler) SetRules(rules []SampleRule) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, r := range s.rules {
+		s.registry.Unregister("rules." + r.Name + ".kept")
+		s.registry.Unregister("rules." + r.Name + ".dropped")
+	}
+	s.rules = rules
+	s.seen = make([]int64, len(rules))
+	s.kept = make([]metrics.Counter, len(rules))
+	s.dropped = make([]metrics.Counter, len(rules))
+	for i, r := range rules {
+		s.kept[i] = metrics.NewCounter()
+		s.dropped[i] = metrics.NewCounter()
+		s.registry.Register("rules."+r.Name+".kept", s.kept[i])
+		s.registry.Register("rules."+r.Name+".dropped", s.dropped[i])
+	}
+}
+
+// Process implements Stage.
+func (s *Sampler) Process(e *input.Event) bool {
+	if e.Parsed == nil {
+		return true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.rules {
+		r := &s.rules[i]
+		if !matchFields(r.Fields, e) {
+			continue
+		}
+
+		var keep bool
+		if r.Every > 0 {
+			keep = s.seen[i]%int64(r.Every) == 0
+			s.seen[i]++
+		} else {
+			keep = s.random()*100 < r.Percent
+		}
+		if !keep {
+			s.dropped[i].Inc(1)
+			s.droppedTotal.Inc(1)
+			return false
+		}
+		s.kept[i].Inc(1)
+		e.Parsed.SampleRate = r.rate()
+		return true
+	}
+	return true
+}
+
+// Statistics returns an object storing statistics, which supports JSON
+// marshalling.
+func (s *Sampler) Statistics() (metrics.Registry, error) {
+	return s.registry, nil
+}
@@ -0,0 +1,160 @@
+package pipeline
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"sync"
+
+	"github.com/otoolep/syslog-gollector/input"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// keyValue matches key=value pairs, where the value may be double-quoted.
+var keyValue = regexp.MustCompile(`(?:^|\s)([A-Za-z_][A-Za-z0-9_.-]*)=("(?:[^"\\]|\\.)*"|[^\s"]*)`)
+
+// A Transform changes the fields of parsed messages. Fields are first
+// extracted from the message -- key=value pairs if KeyValue is set, and the
+// named groups of each of Patterns which matches -- and then renamed,
+// added, and dropped, in that order. Extracted fields never replace fields
+// already present, while added fields always do.
+type Transform struct {
+	KeyValue bool
+	Patterns []*regexp.Regexp
+	Rename   map[string]string // Maps old names to new
+	Add      map[string]string
+	Drop     []string
+}
+
+// empty returns whether the Transform changes nothing.
+func (t *Transform) empty() bool {
+	return !t.KeyValue && len(t.Patterns) == 0 && len(t.Rename) == 0 && len(t.Add) == 0 && len(t.Drop) == 0
+}
+
+// apply applies the Transform to the fields, returning the number of fields
+// extracted.
+func (t *Transform) apply(fields map[string]interface{}) int {
+	extracted := 0
+	extract := func(k, v string) {
+		if _, ok := fields[k]; !ok {
+			fields[k] = v
+			extracted++
+		}
+	}
+
+	msg, _ := fields[input.FieldMessage].(string)
+	if t.KeyValue {
+		for _, m := range keyValue.FindAllStringSubmatch(msg, -1) {
+			v := m[2]
+			if u, err := strconv.Unquote(v); err == nil {
+				v = u
+			}
+			extract(m[1], v)
+		}
+	}
+	for _, re := range t.Patterns {
+		m := re.FindStringSubmatch(msg)
+		if m == nil {
+			continue
+		}
+		for i, name := range re.SubexpNames() {
+			if name != "" && m[i] != "" {
+				extract(name, m[i])
+			}
+		}
+	}
+
+	for from, to := range t.Rename {
+		if v, ok := fields[from]; ok {
+			delete(fields, from)
+			fields[to] = v
+		}
+	}
+	for k, v := range t.Add {
+		fields[k] = v
+	}
+	for _, k := range t.Drop {
+		delete(fields, k)
+	}
+	return extracted
+}
+
+// A Transformer is a Stage which applies a Transform to each parsed Event,
+// setting the Event's Fields. Events which have not been parsed are not
+// changed.
+type Transformer struct {
+	mu        sync.RWMutex
+	transform Transform
+
+	registry    metrics.Registry
+	transformed metrics.Counter
+	extracted   metrics.Counter
+	errors      metrics.Counter
+}
+
+// NewTransformer returns a Transformer applying the given Transform.
+func NewTransformer(t Transform) *Transformer {
+	x := &Transformer{transform: t}
+
+	x.registry = metrics.NewRegistry()
+	x.transformed = metrics.NewCounter()
+	x.extracted = metrics.NewCounter()
+	x.errors = metrics.NewCounter()
+	x.registry.Register("events.transformed", x.transformed)
+	x.registry.Register("fields.extracted", x.extracted)
+	x.registry.Register("events.errors", x.errors)
+	return x
+}
+
+// SetTransform replaces the Transform applied by the Transformer.
+func (x *Transformer) SetTransform(t Transform) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.transform = t
+}
+
+// Process implements Stage. An Event whose fields cannot be decoded is
+// passed on unchanged.
+func (x *Transformer) Process(e *input.Event) bool {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	if e.Parsed == nil || x.transform.empty() {
+		return true
+	}
+
+	fields := e.Fields
+	if fields == nil {
+		var err error
+		if fields, err = decode(e.Parsed); err != nil {
+			x.errors.Inc(1)
+			return true
+		}
+	}
+	x.extracted.Inc(int64(x.transform.apply(fields)))
+	x.transformed.Inc(1)
+	e.Fields = fields
+	return true
+}
+
+// Statistics returns an object storing statistics, which supports JSON
+// marshalling.
+func (x *Transformer) Statistics() (metrics.Registry, error) {
+	return x.registry, nil
+}
+
+// decode returns the fields of the parsed message, as encoded in JSON.
+func decode(m *input.ParsedMessage) (map[string]interface{}, error) {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var fields map[string]interface{}
+	if err := d.Decode(&fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"time"
+
+	"github.com/otoolep/syslog-gollector/config"
+	"github.com/otoolep/syslog-gollector/input"
+	"github.com/otoolep/syslog-gollector/output"
+)
+
+// A reloadReport describes the result of reloading the configuration.
+type reloadReport struct {
+	Applied []string `json:"applied"`
+	Restart []string `json:"requires_restart"`
+	Errors  []string `json:"errors"`
+}
+
+func (r *reloadReport) applied(field string, from, to interface{}) {
+	r.Applied = append(r.Applied, fmt.Sprintf("%s: %v -> %v", field, from, to))
+}
+
+func (r *reloadReport) restart(field string, from, to interface{}) {
+	r.Restart = append(r.Restart, fmt.Sprintf("%s: %v -> %v", field, from, to))
+}
+
+func (r *reloadReport) error(field string, err error) {
+	r.Errors = append(r.Errors, fmt.Sprintf("%s: %s", field, err.Error()))
+}
+
+// reloads carries reload requests to the main loop, which sends the report
+// on the enclosed channel.
+var reloads = make(chan chan reloadReport)
+
+// reloadTimeout is how long to wait for the main loop to reload the
+// configuration, which it only does between writes to Kafka.
+var reloadTimeout = 30 * time.Second
+
+// errReloadTimeout is returned if the main loop does not reload the
+// configuration within reloadTimeout.
+var errReloadTimeout = errors.New("timed out waiting for the configuration to be reloaded")
+
+// requestReload asks the main loop to reload the configuration, and waits
+// for the result, for at most reloadTimeout. If it times out, the reload
+// may still take place later.
+func requestReload() (reloadReport, error) {
+	ch := make(chan reloadReport, 1)
+	timeout := time.After(reloadTimeout)
+	var r reloadReport
+	select {
+	case reloads <- ch:
+	case <-timeout:
+		log.Println("configuration reload failed:", errReloadTimeout)
+		return r, errReloadTimeout
+	}
+	select {
+	case r = <-ch:
+	case <-timeout:
+		log.Println("configuration reload failed:", errReloadTimeout)
+		return r, errReloadTimeout
+	}
+
+	for _, s := range r.Applied {
+		log.Println("configuration change applied:", s)
+	}
+	for _, s := range r.Restart {
+		log.Println("configuration change requires restart:", s)
+	}
+	for _, s := range r.Errors {
+		log.Println("configuration change failed:", s)
+	}
+	return r, nil
+}
+
+// ServeReload reloads the configuration, and returns what changed.
+func ServeReload(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "reload requires POST", http.StatusMethodNotAllowed)
+		return
+	}
+	r, err := requestReload()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	code := http.StatusOK
+	if len(r.Errors) > 0 {
+		code = http.StatusInternalServerError
+	}
+	writeJSON(w, req, r, code)
+}
+
+// loadConfig returns the configuration as built at startup -- the defaults,
+// overridden by the configuration file, overridden by flags.
+func loadConfig() (*config.Config, error) {
+	c := config.Default()
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	fs.String("config", "", "")
+	c.Flags(fs)
+
+	if configPath != "" {
+		if err := c.Load(configPath); err != nil {
+			return nil, err
+		}
+	}
+	if err := fs.Parse(os.Args[1:]); err != nil {
+		return nil, err
+	}
+	return c, c.Validate()
+}
+
+// reload re-reads the configuration, and applies the changes which can be
+// applied while running. It must only be called by the main loop, so that
+// no message is written while the producer is being replaced.
+func reload() reloadReport {
+	next, err := loadConfig()
+	if err != nil {
+		var r reloadReport
+		r.error("config", err)
+		return r
+	}
+	return apply(next)
+}
+
+// apply changes the running configuration to next, which must be valid,
+// applying the changes which can be applied while running. It must only be
+// called by the main loop.
+func apply(next *config.Config) reloadReport {
+	var r reloadReport
+	var err error
+
+	// Connect to Kafka before taking the lock, as it may take some time.
+	var p *output.KafkaProducer
+	if !reflect.DeepEqual(next.Output, cfg.Output) {
+		p, err = newProducer(next)
+		if err != nil {
+			r.error("output", err)
+			next.Output = cfg.Output
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	// Changes to these settings are reported, but not applied.
+	if next.Admin != cfg.Admin {
+		r.restart("admin", cfg.Admin, next.Admin)
+		next.Admin = cfg.Admin
+	}
+	if !reflect.DeepEqual(next.Parser, cfg.Parser) {
+		r.restart("parser", cfg.Parser, next.Parser)
+		next.Parser = cfg.Parser
+	}
+	if !reflect.DeepEqual(next.Channels, cfg.Channels) {
+		r.restart("channels", cfg.Channels, next.Channels)
+		next.Channels = cfg.Channels
+	}
+	if next.DeadLetter != cfg.DeadLetter {
+		if err := reloadDeadFile(next.DeadLetter); err == errRestart {
+			r.restart("dead_letter", cfg.DeadLetter, next.DeadLetter)
+			next.DeadLetter = cfg.DeadLetter
+		} else if err != nil {
+			r.error("dead_letter.file", err)
+			next.DeadLetter = cfg.DeadLetter
+		} else {
+			r.applied("dead_letter.file", cfg.DeadLetter.File, next.DeadLetter.File)
+		}
+	}
+	if !reflect.DeepEqual(next.Silence, cfg.Silence) {
+		r.restart("silence", cfg.Silence, next.Silence)
+		next.Silence = cfg.Silence
+	}
+
+	tcpACL, udpACL := acl(next.Listeners.TCPAccess), acl(next.Listeners.UDPAccess)
+	if next.Listeners.TCP != cfg.Listeners.TCP {
+		if err := reloadTcpServer(next.Listeners.TCP, tcpACL, tcpLimits(next.Listeners.TCPConnections), multiline(next.Listeners.TCPMultiline)); err != nil {
+			r.error("listeners.tcp", err)
+			next.Listeners.TCP = cfg.Listeners.TCP
+		} else {
+			r.applied("listeners.tcp", cfg.Listeners.TCP, next.Listeners.TCP)
+		}
+	}
+	if next.Listeners.UDP != cfg.Listeners.UDP {
+		if err := reloadUdpServer(next.Listeners.UDP, udpACL); err != nil {
+			r.error("listeners.udp", err)
+			next.Listeners.UDP = cfg.Listeners.UDP
+		} else {
+			r.applied("listeners.udp", cfg.Listeners.UDP, next.Listeners.UDP)
+		}
+	}
+	if !reflect.DeepEqual(next.Listeners.TCPAccess, cfg.Listeners.TCPAccess) {
+		if tcpServer != nil {
+			tcpServer.SetACL(tcpACL)
+		}
+		r.applied("listeners.tcp_access", cfg.Listeners.TCPAccess, next.Listeners.TCPAccess)
+	}
+	if next.Listeners.TCPConnections != cfg.Listeners.TCPConnections {
+		if tcpServer != nil {
+			tcpServer.SetLimits(tcpLimits(next.Listeners.TCPConnections))
+		}
+		r.applied("listeners.tcp_connections", cfg.Listeners.TCPConnections, next.Listeners.TCPConnections)
+	}
+	if !reflect.DeepEqual(next.Listeners.TCPMultiline, cfg.Listeners.TCPMultiline) {
+		if tcpServer != nil {
+			tcpServer.SetMultiline(multiline(next.Listeners.TCPMultiline))
+		}
+		r.applied("listeners.tcp_multiline", cfg.Listeners.TCPMultiline, next.Listeners.TCPMultiline)
+	}
+	if !reflect.DeepEqual(next.Listeners.UDPAccess, cfg.Listeners.UDPAccess) {
+		if udpServer != nil {
+			udpServer.SetACL(udpACL)
+		}
+		r.applied("listeners.udp_access", cfg.Listeners.UDPAccess, next.Listeners.UDPAccess)
+	}
+	if monitor != nil {
+		monitor.SetTrackers(trackers()...)
+	}
+
+	if p != nil {
+		// Closing the old producer flushes any messages it has buffered.
+		if err := producer.Close(); err != nil {
+			log.Println("failed to close Kafka producer cleanly:", err)
+		}
+		producer = p
+		r.applied("output", cfg.Redacted().Output, next.Redacted().Output)
+	}
+	if !reflect.DeepEqual(next.RateLimits, cfg.RateLimits) {
+		limiter.SetRules(rateRules(next.RateLimits))
+		r.applied("rate_limits", cfg.RateLimits, next.RateLimits)
+	}
+	if !reflect.DeepEqual(next.Filters, cfg.Filters) {
+		filter.SetRules(filterRules(next.Filters))
+		r.applied("filters", cfg.Filters, next.Filters)
+	}
+	if !reflect.DeepEqual(next.Sampling, cfg.Sampling) {
+		sampler.SetRules(sampleRules(next.Sampling))
+		r.applied("sampling", cfg.Sampling, next.Sampling)
+	}
+	if !reflect.DeepEqual(next.Redact, cfg.Redact) || next.RedactKey != cfg.RedactKey {
+		redactor.SetRules(redactRules(next.Redact, next.RedactKey))
+		if !reflect.DeepEqual(next.Redact, cfg.Redact) {
+			r.applied("redact", cfg.Redact, next.Redact)
+		}
+		if next.RedactKey != cfg.RedactKey {
+			r.applied("redact_key", cfg.Redacted().RedactKey, next.Redacted().RedactKey)
+		}
+	}
+	if !reflect.DeepEqual(next.Transform, cfg.Transform) {
+		transformer.SetTransform(transform(next.Transform))
+		r.applied("transform", cfg.Transform, next.Transform)
+	}
+	if !reflect.DeepEqual(next.Dedup, cfg.Dedup) {
+		dedup.Set(time.Duration(next.Dedup.Window)*time.Second, next.Dedup.Key)
+		r.applied("dedup", cfg.Dedup, next.Dedup)
+	}
+	if !reflect.DeepEqual(next.Routing, cfg.Routing) {
+		producer.SetRoutes(routes(next.Routing.Rules))
+		r.applied("routing", cfg.Routing, next.Routing)
+	}
+
+	cfg = next
+	return r
+}
+
+// errRestart is returned by reloadDeadFile if the change can only be
+// applied by a restart.
+var errRestart = errors.New("requires restart")
+
+// reloadDeadFile replaces the dead-letter file with the one configured by
+// next, flushing and closing the old file. Only a change from one file to
+// another can be applied while running, as the parser and the dead-letter
+// channel are set up at startup; for any other change errRestart is
+// returned.
+func reloadDeadFile(next config.DeadLetter) error {
+	if cfg.DeadLetter.File == "" || next.File == "" || next.Topic != cfg.DeadLetter.Topic {
+		return errRestart
+	}
+	f, err := output.NewFileWriter(next.File)
+	if err != nil {
+		return err
+	}
+	if deadFile != nil {
+		if err := deadFile.Close(); err != nil {
+			log.Println("failed to close dead-letter file cleanly:", err)
+		}
+	}
+	deadFile = f
+	return nil
+}
+
+// reloadTcpServer replaces the TcpServer with one listening on iface,
+// accepting the senders permitted by acl within the limits and assembling
+// messages as set by multiline, or none if iface is empty. If the new
+// server fails to start, the old server is restarted.
+func reloadTcpServer(iface string, acl *input.ACL, limits input.TcpLimits, multiline input.Multiline) error {
+	old := tcpServer
+	if old != nil {
+		old.Stop()
+	}
+	if iface == "" {
+		tcpServer = nil
+		return nil
+	}
+
+	s, err := startTcpServer(iface, acl, limits, multiline)
+	if err != nil {
+		if old != nil {
+			if err := old.Start(rawInput); err != nil {
+				log.Println("failed to restart TCP server:", err)
+				tcpServer = nil
+			}
+		}
+		return err
+	}
+	tcpServer = s
+	return nil
+}
+
+// reloadUdpServer replaces the UdpServer with one listening on iface,
+// accepting the senders permitted by acl, or none if iface is empty. If
+// the new server fails to start, the old server is restarted.
+func reloadUdpServer(iface string, acl *input.ACL) error {
+	old := udpServer
+	if old != nil {
+		old.Stop()
+	}
+	if iface == "" {
+		udpServer = nil
+		return nil
+	}
+
+	s, err := startUdpServer(iface, acl)
+	if err != nil {
+		if old != nil {
+			if err := old.Start(rawInput); err != nil {
+				log.Println("failed to restart UDP server:", err)
+				udpServer = nil
+			}
+		}
+		return err
+	}
+	udpServer = s
+	return nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/otoolep/syslog-gollector/config"
+	"github.com/otoolep/syslog-gollector/output"
+	. "gopkg.in/check.v1"
+)
+
+// fields returns the names of the settings in report lines.
+func fields(lines []string) []string {
+	var f []string
+	for _, l := range lines {
+		f = append(f, strings.SplitN(l, ":", 2)[0])
+	}
+	return f
+}
+
+func (s *MainSuite) Test_ReloadApply(c *C) {
+	// Hold an address, so that a listener cannot be bound to it.
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer taken.Close()
+
+	tests := []struct {
+		name    string
+		tcp     string // The TCP listener before the reload
+		change  func(next *config.Config)
+		applied []string
+		restart []string
+		errors  []string
+		bound   bool // Whether a TCP listener is bound afterwards
+	}{
+		{"no change", "", func(next *config.Config) {}, nil, nil, nil, false},
+		{"tcp listener added", "", func(next *config.Config) { next.Listeners.TCP = "127.0.0.1:0" },
+			[]string{"listeners.tcp"}, nil, nil, true},
+		{"tcp listener removed", "127.0.0.1:0", func(next *config.Config) { next.Listeners.TCP = "" },
+			[]string{"listeners.tcp"}, nil, nil, false},
+		{"tcp listener fails to bind", "127.0.0.1:0", func(next *config.Config) { next.Listeners.TCP = taken.Addr().String() },
+			nil, nil, []string{"listeners.tcp"}, true},
+		{"requires restart", "", func(next *config.Config) {
+			next.Admin = "localhost:8081"
+			next.Parser.Workers = 4
+			next.Channels.Capacity = 100
+			next.DeadLetter.Topic = "dead"
+			next.Silence.Threshold = 60
+		}, nil, []string{"admin", "parser", "channels", "dead_letter", "silence"}, nil, false},
+		{"applied and requires restart", "", func(next *config.Config) {
+			next.Admin = "localhost:8081"
+			next.Listeners.TCPMultiline.Whitespace = true
+		}, []string{"listeners.tcp_multiline"}, []string{"admin"}, nil, false},
+	}
+
+	for _, tt := range tests {
+		cfg = config.Default()
+		cfg.Listeners.TCP, cfg.Listeners.UDP = tt.tcp, ""
+		tcpServer = nil
+		if tt.tcp != "" {
+			tcpServer, err = startTcpServer(tt.tcp, acl(cfg.Listeners.TCPAccess), tcpLimits(cfg.Listeners.TCPConnections), multiline(cfg.Listeners.TCPMultiline))
+			c.Assert(err, IsNil, Commentf(tt.name))
+		}
+		prev := *cfg
+		next := *cfg
+		tt.change(&next)
+
+		r := apply(&next)
+		c.Assert(fields(r.Applied), DeepEquals, tt.applied, Commentf(tt.name))
+		c.Assert(fields(r.Restart), DeepEquals, tt.restart, Commentf(tt.name))
+		c.Assert(fields(r.Errors), DeepEquals, tt.errors, Commentf(tt.name))
+		c.Assert(tcpServer != nil, Equals, tt.bound, Commentf(tt.name))
+
+		// Settings which were not applied keep their previous values.
+		if tt.restart != nil {
+			c.Assert(cfg.Admin, Equals, prev.Admin, Commentf(tt.name))
+			c.Assert(cfg.Parser, DeepEquals, prev.Parser, Commentf(tt.name))
+		}
+		if tt.errors != nil {
+			c.Assert(cfg.Listeners.TCP, Equals, prev.Listeners.TCP, Commentf(tt.name))
+		}
+
+		if tcpServer != nil {
+			tcpServer.Stop()
+			tcpServer = nil
+		}
+	}
+}
+
+func (s *MainSuite) Test_ReloadDeadFile(c *C) {
+	dir := c.MkDir()
+	cfg.Listeners.TCP, cfg.Listeners.UDP = "", ""
+	cfg.DeadLetter.File = filepath.Join(dir, "old.log")
+	var err error
+	deadFile, err = output.NewFileWriter(cfg.DeadLetter.File)
+	c.Assert(err, IsNil)
+	defer func() { deadFile.Close(); deadFile = nil }()
+	deadFile.Write("old")
+
+	next := *cfg
+	next.DeadLetter.File = filepath.Join(dir, "new.log")
+	r := apply(&next)
+	c.Assert(fields(r.Applied), DeepEquals, []string{"dead_letter.file"})
+	c.Assert(r.Errors, IsNil)
+	c.Assert(cfg.DeadLetter.File, Equals, next.DeadLetter.File)
+
+	// The old file was flushed and closed.
+	b, err := ioutil.ReadFile(filepath.Join(dir, "old.log"))
+	c.Assert(err, IsNil)
+	c.Assert(string(b), Equals, "old\n")
+
+	// A file which cannot be opened leaves the current file in place.
+	missing := *cfg
+	missing.DeadLetter.File = filepath.Join(dir, "missing", "dead.log")
+	r = apply(&missing)
+	c.Assert(fields(r.Errors), DeepEquals, []string{"dead_letter.file"})
+	c.Assert(cfg.DeadLetter.File, Equals, filepath.Join(dir, "new.log"))
+
+	// Disabling the file requires a restart.
+	disabled := *cfg
+	disabled.DeadLetter.File = ""
+	r = apply(&disabled)
+	c.Assert(fields(r.Restart), DeepEquals, []string{"dead_letter"})
+	c.Assert(cfg.DeadLetter.File, Equals, filepath.Join(dir, "new.log"))
+}
+
+func (s *MainSuite) Test_ReloadTimeout(c *C) {
+	defer func(d time.Duration) { reloadTimeout = d }(reloadTimeout)
+	reloadTimeout = 10 * time.Millisecond
+
+	// Nothing receives from reloads, as the main loop is not running.
+	w := httptest.NewRecorder()
+	ServeReload(w, httptest.NewRequest("POST", "/reload", nil))
+	c.Assert(w.Code, Equals, http.StatusServiceUnavailable)
+}
+
+func (s *MainSuite) Test_ReloadMethod(c *C) {
+	w := httptest.NewRecorder()
+	ServeReload(w, httptest.NewRequest("GET", "/reload", nil))
+	c.Assert(w.Code, Equals, http.StatusMethodNotAllowed)
+	c.Assert(w.Header().Get("Allow"), Equals, "POST")
+}
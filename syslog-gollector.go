@@ -5,39 +5,61 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"reflect"
+	"regexp"
 	"runtime"
-	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/otoolep/syslog-gollector/config"
 	"github.com/otoolep/syslog-gollector/input"
 	"github.com/otoolep/syslog-gollector/output"
+	"github.com/otoolep/syslog-gollector/pipeline"
 	"github.com/rcrowley/go-metrics"
 )
 
 // Program parameters
-var adminIface string
-var tcpIface string
-var udpIface string
-var kBrokers string
-var kBatch int
-var kTopic string
-var kBufferTime int
-var kBufferBytes int
-var pEnabled bool
-var cCapacity int
-
-// Program resources
+var configPath string
+var cfg = config.Default()
+
+// Program resources. Once the program has started, mu must be held to
+// change cfg, tcpServer, udpServer or producer, or to read them from any
+// goroutine other than main's.
+var mu sync.RWMutex
 var tcpServer *input.TcpServer
 var udpServer *input.UdpServer
 var parser *input.Rfc5424Parser
 var producer *output.KafkaProducer
+var monitor *input.SilenceMonitor
+var deadFile *output.FileWriter
+var limiter *pipeline.RateLimiter
+var peerLimiter pipeline.Stage // The rules of limiter by peer
+var filter *pipeline.Filter
+var sampler *pipeline.Sampler
+var redactor *pipeline.Redactor
+var transformer *pipeline.Transformer
+var dedup *pipeline.Dedup
+var rawQueue *input.Queue
+var prodQueue *input.Queue
+var deadQueue *input.Queue
+
+// toOutput passes an Event through the pipeline stages which follow parsing,
+// and then to the output.
+var toOutput func(*input.Event)
 
 // Diagnostic data
 var startTime time.Time
 
+// Build information, set at build time via -ldflags.
+var version = "unknown"
+var commit = "unknown"
+
 // Statistics is the interface systems that provide statistics must support.
 type Statistics interface {
 	Statistics() (metrics.Registry, error)
@@ -45,30 +67,15 @@ type Statistics interface {
 
 // Types
 const (
-	adminHost        = "localhost:8080"
-	connTcpHost      = "localhost:514"
-	connUdpHost      = "localhost:514"
-	connType         = "tcp"
-	kafkaBatch       = 10
-	kafkaBrokers     = "localhost:9092"
-	kafkaTopic       = "logs"
-	kafkaBufferTime  = 1000
-	kafkaBufferBytes = 512 * 1024
-	parseEnabled     = true
-	chanCapacity     = 0
+	silenceInterval  = 10 * time.Second
+	summaryInterval  = time.Minute
+	dedupInterval    = time.Second
+	readyErrorWindow = 30 * time.Second
 )
 
 func init() {
-	flag.StringVar(&adminIface, "admin", adminHost, "Admin interface")
-	flag.StringVar(&tcpIface, "tcp", connTcpHost, "TCP bind interface. If set to empty string, not enabled")
-	flag.StringVar(&udpIface, "udp", connUdpHost, "UDP interface. If set to empty string, not enabled")
-	flag.StringVar(&kBrokers, "broker", kafkaBrokers, "comma-delimited kafka brokers")
-	flag.StringVar(&kTopic, "topic", kafkaTopic, "kafka topic")
-	flag.IntVar(&kBatch, "batch", kafkaBatch, "Kafka batch size")
-	flag.IntVar(&kBufferTime, "maxbuff", kafkaBufferTime, "Kafka client buffer max time (ms)")
-	flag.IntVar(&kBufferBytes, "maxbytes", kafkaBufferBytes, "Kafka client buffer max bytes")
-	flag.BoolVar(&pEnabled, "parse", parseEnabled, "enable syslog header parsing")
-	flag.IntVar(&cCapacity, "chancap", chanCapacity, "channel buffering capacity")
+	flag.StringVar(&configPath, "config", "", "configuration file (JSON, YAML or TOML). Flags override its settings")
+	cfg.Flags(flag.CommandLine)
 }
 
 // isPretty returns whether the HTTP response body should be pretty-printed.
@@ -83,12 +90,41 @@ func isPretty(req *http.Request) (bool, error) {
 	return false, nil
 }
 
+// writeJSON writes v as the JSON body of the response, with the status
+// code status, pretty-printed if requested.
+func writeJSON(w http.ResponseWriter, req *http.Request, v interface{}, status int) {
+	var b []byte
+	var err error
+	pretty, _ := isPretty(req)
+	if pretty {
+		b, err = json.MarshalIndent(v, "", "    ")
+	} else {
+		b, err = json.Marshal(v)
+	}
+	if err != nil {
+		log.Println("failed to JSON marshal response:", err)
+		http.Error(w, "failed to JSON marshal response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
 // ServeStatistics returns the statistics for the program
 func ServeStatistics(w http.ResponseWriter, req *http.Request) {
 	statistics := make(map[string]interface{})
-	resources := map[string]Statistics{"tcp": tcpServer, "udp": udpServer, "parser": parser, "producer": producer}
+	mu.RLock()
+	defer mu.RUnlock()
+	resources := map[string]Statistics{"tcp": tcpServer, "udp": udpServer, "parser": parser, "producer": producer, "silence": monitor, "rateLimit": limiter, "filter": filter, "sampling": sampler, "redact": redactor, "transform": transformer, "dedup": dedup, "rawQueue": rawQueue, "deadLetter": deadFile}
+	if prodQueue != rawQueue {
+		resources["prodQueue"] = prodQueue
+	}
+	if cfg.DeadLetter.Topic != "" {
+		resources["deadQueue"] = deadQueue
+	}
 	for k, v := range resources {
-		if v == nil {
+		if v == nil || reflect.ValueOf(v).IsNil() {
 			// No stats for uninitialized resources
 			continue
 		}
@@ -102,51 +138,443 @@ func ServeStatistics(w http.ResponseWriter, req *http.Request) {
 		statistics[k] = s
 	}
 
-	var b []byte
-	var err error
-	pretty, _ := isPretty(req)
-	if pretty {
-		b, err = json.MarshalIndent(statistics, "", "    ")
-	} else {
-		b, err = json.Marshal(statistics)
+	writeJSON(w, req, statistics, http.StatusOK)
+}
+
+// Diagnostics is the information served by ServeDiagnostics.
+type Diagnostics struct {
+	Started    time.Time         `json:"started"`
+	Uptime     string            `json:"uptime"`
+	Version    string            `json:"version"`
+	Commit     string            `json:"commit"`
+	GoVersion  string            `json:"go_version"`
+	NumCPU     int               `json:"num_cpu"`
+	GOMAXPROCS int               `json:"gomaxprocs"`
+	Goroutines int               `json:"goroutines"`
+	Memory     MemoryDiagnostics `json:"memory"`
+	Listeners  map[string]string `json:"listeners"`
+	Config     *config.Config    `json:"config"`
+}
+
+// MemoryDiagnostics is a summary of the runtime memory statistics. Sizes are
+// in bytes.
+type MemoryDiagnostics struct {
+	Alloc      uint64 `json:"alloc"`
+	TotalAlloc uint64 `json:"total_alloc"`
+	Sys        uint64 `json:"sys"`
+	HeapAlloc  uint64 `json:"heap_alloc"`
+	HeapInuse  uint64 `json:"heap_inuse"`
+	NumGC      uint32 `json:"num_gc"`
+}
+
+// ServeDiagnostics serves diagnostic and status information about the server,
+// including the effective configuration, with secrets redacted.
+func ServeDiagnostics(w http.ResponseWriter, req *http.Request) {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+
+	mu.RLock()
+	defer mu.RUnlock()
+	diagnostics := Diagnostics{
+		Started:    startTime,
+		Uptime:     time.Since(startTime).String(),
+		Version:    version,
+		Commit:     commit,
+		GoVersion:  runtime.Version(),
+		NumCPU:     runtime.NumCPU(),
+		GOMAXPROCS: runtime.GOMAXPROCS(0),
+		Goroutines: runtime.NumGoroutine(),
+		Memory: MemoryDiagnostics{
+			Alloc:      m.Alloc,
+			TotalAlloc: m.TotalAlloc,
+			Sys:        m.Sys,
+			HeapAlloc:  m.HeapAlloc,
+			HeapInuse:  m.HeapInuse,
+			NumGC:      m.NumGC,
+		},
+		Listeners: make(map[string]string),
+		Config:    cfg.Redacted(),
+	}
+	if tcpServer != nil && tcpServer.Addr() != nil {
+		diagnostics.Listeners["tcp"] = tcpServer.Addr().String()
+	}
+	if udpServer != nil && udpServer.Addr() != nil {
+		diagnostics.Listeners["udp"] = udpServer.Addr().String()
+	}
+
+	writeJSON(w, req, diagnostics, http.StatusOK)
+}
+
+// ServeAlerts returns the hosts which have stopped sending logs.
+func ServeAlerts(w http.ResponseWriter, req *http.Request) {
+	alerts := []input.Alert{}
+	if monitor != nil {
+		alerts = monitor.Alerts()
+	}
+
+	writeJSON(w, req, alerts, http.StatusOK)
+}
+
+// ServeFailures returns a sample of the most recent messages which could not
+// be parsed, and why.
+func ServeFailures(w http.ResponseWriter, req *http.Request) {
+	failures := []input.DeadLetter{}
+	if parser != nil {
+		failures = parser.Failures().Recent()
+	}
+
+	writeJSON(w, req, failures, http.StatusOK)
+}
+
+// A check is the result of a single readiness check.
+type check struct {
+	OK     bool   `json:"ok"`
+	Reason string `json:"reason"`
+}
+
+// listenerCheck checks that a server, if enabled, is bound to its interface.
+func listenerCheck(iface string, addr net.Addr) check {
+	if addr == nil {
+		return check{false, "not listening on " + iface}
+	}
+	return check{true, "listening on " + addr.String()}
+}
+
+// queueCheck checks that a queue is not saturated. An unbuffered queue
+// always passes, as it is never saturated.
+func queueCheck(q *input.Queue) check {
+	if q == nil {
+		return check{false, "not created"}
+	}
+	if cap(q.C) == 0 {
+		return check{true, "unbuffered, saturation does not apply"}
+	}
+	reason := fmt.Sprintf("%d of %d buffered", len(q.C), cap(q.C))
+	if q.Saturated() {
+		return check{false, "saturated, " + reason}
+	}
+	return check{true, reason}
+}
+
+// kafkaCheck checks that the producer is connected, and not erroring.
+// lastError returns the producer's last error, and is nil if there is no
+// producer.
+func kafkaCheck(lastError func() (time.Time, error)) check {
+	if lastError == nil {
+		return check{false, "not connected to " + strings.Join(cfg.Output.Kafka.Brokers, ",")}
+	}
+	if t, err := lastError(); err != nil && time.Since(t) < readyErrorWindow {
+		return check{false, fmt.Sprintf("error at %s: %s", t.Format(time.RFC3339), err.Error())}
+	}
+	return check{true, "connected to " + strings.Join(cfg.Output.Kafka.Brokers, ",")}
+}
+
+// ServeHealth reports that the process is alive.
+func ServeHealth(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"status":"ok"}`))
+}
+
+// ServeReady reports whether the pipeline is ready to accept messages. If
+// it is not, the status code is 503.
+func ServeReady(w http.ResponseWriter, req *http.Request) {
+	checks := make(map[string]check)
+	mu.RLock()
+	defer mu.RUnlock()
+	if cfg.Listeners.TCP != "" {
+		var addr net.Addr
+		if tcpServer != nil {
+			addr = tcpServer.Addr()
+		}
+		checks["tcp"] = listenerCheck(cfg.Listeners.TCP, addr)
+	}
+	if cfg.Listeners.UDP != "" {
+		var addr net.Addr
+		if udpServer != nil {
+			addr = udpServer.Addr()
+		}
+		checks["udp"] = listenerCheck(cfg.Listeners.UDP, addr)
+	}
+	var lastError func() (time.Time, error)
+	if producer != nil {
+		lastError = producer.LastError
+	}
+	checks["kafka"] = kafkaCheck(lastError)
+	checks["rawQueue"] = queueCheck(rawQueue)
+	checks["prodQueue"] = queueCheck(prodQueue)
+	if cfg.DeadLetter.Topic != "" {
+		checks["deadQueue"] = queueCheck(deadQueue)
+	}
+	serveChecks(w, req, checks)
+}
+
+// serveChecks writes the result of the readiness checks. If any failed,
+// the status code is 503.
+func serveChecks(w http.ResponseWriter, req *http.Request, checks map[string]check) {
+	ready := true
+	for _, c := range checks {
+		ready = ready && c.OK
+	}
+	status := map[string]interface{}{"ready": ready, "checks": checks}
+
+	code := http.StatusOK
+	if !ready {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, req, status, code)
+}
+
+// rawInput passes a received Event to the first stage of the pipeline,
+// unless it is over a rate limit by peer.
+func rawInput(e *input.Event) {
+	if !peerLimiter.Process(e) {
+		return
+	}
+	if rawQueue == prodQueue {
+		// Not parsing, so the Event goes straight to the later stages.
+		toOutput(e)
+		return
+	}
+	rawQueue.Put(e)
+}
+
+// startTcpServer starts a TcpServer on iface, accepting the senders
+// permitted by acl, within the limits, and assembling messages as set by
+// multiline.
+func startTcpServer(iface string, acl *input.ACL, limits input.TcpLimits, multiline input.Multiline) (*input.TcpServer, error) {
+	s := input.NewTcpServer(iface)
+	s.SetACL(acl)
+	s.SetLimits(limits)
+	s.SetMultiline(multiline)
+	err := s.Start(rawInput)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("listening on %s for TCP connections", iface)
+	return s, nil
+}
+
+// startUdpServer starts a UdpServer on iface, accepting the senders
+// permitted by acl.
+func startUdpServer(iface string, acl *input.ACL) (*input.UdpServer, error) {
+	s := input.NewUdpServer(iface)
+	if s == nil {
+		return nil, fmt.Errorf("unable to resolve %s", iface)
 	}
+	s.SetACL(acl)
+	err := s.Start(rawInput)
 	if err != nil {
-		log.Println("failed to JSON marshal statistics map")
-		http.Error(w, "failed to JSON marshal statistics map", http.StatusInternalServerError)
+		return nil, err
+	}
+	log.Printf("listening on %s for UDP packets", iface)
+	return s, nil
+}
+
+// trackers returns the PeerTrackers of the running servers.
+func trackers() []*input.PeerTracker {
+	var t []*input.PeerTracker
+	if tcpServer != nil {
+		t = append(t, tcpServer.Peers())
+	}
+	if udpServer != nil {
+		t = append(t, udpServer.Peers())
+	}
+	return t
+}
+
+// newProducer connects to Kafka as configured by c.
+func newProducer(c *config.Config) (*output.KafkaProducer, error) {
+	k := c.Output.Kafka
+	brokers := strings.Join(k.Brokers, ",")
+	log.Println("attempting to connect to Kafka brokers at:", brokers)
+	p, err := output.NewKafkaProducer(k.Brokers, k.Topic, k.BufferTime, k.BufferBytes, k.Batch)
+	if err != nil {
+		return nil, err
+	}
+	p.SetRoutes(routes(c.Routing.Rules))
+	log.Printf("connected to Kafka at %s", brokers)
+	return p, nil
+}
+
+// deadLetter writes an Event which could not be parsed to the dead-letter
+// file, or queues it to be written to the dead-letter topic.
+func deadLetter(e *input.Event, reason string) {
+	b, err := json.Marshal(input.NewDeadLetter(e, reason))
+	if err != nil {
+		log.Println("failed to JSON marshal dead letter:", err)
 		return
 	}
-	w.Write(b)
+	mu.RLock()
+	if deadFile != nil {
+		deadFile.Write(string(b))
+		mu.RUnlock()
+		return
+	}
+	mu.RUnlock()
+	// Writing to Kafka may block, so it is left to the main loop, which
+	// does not hold mu.
+	deadQueue.Put(input.NewEvent(string(b), e.Source))
 }
 
-// ServeDiagnostics serves diagnostic and status information about the server.
-func ServeDiagnostics(w http.ResponseWriter, req *http.Request) {
-	diagnostics := make(map[string]string)
-	diagnostics["started"] = startTime.String()
-	diagnostics["uptime"] = time.Since(startTime).String()
-	diagnostics["kafkaBatch"] = strconv.Itoa(kafkaBatch)
-	diagnostics["kBufferTime"] = strconv.Itoa(kBufferTime)
-	diagnostics["kBufferBytes"] = strconv.Itoa(kBufferBytes)
-	diagnostics["cCapacity"] = strconv.Itoa(cCapacity)
-	diagnostics["kTopic"] = kTopic
-
-	if pEnabled {
-		diagnostics["parsing"] = "enabled"
-	} else {
-		diagnostics["parsing"] = "disabled"
+// shutdown flushes and closes the dead-letter file and the producer, so
+// that the messages they have buffered are not lost when the program exits.
+func shutdown() {
+	mu.Lock()
+	defer mu.Unlock()
+	if deadFile != nil {
+		if err := deadFile.Close(); err != nil {
+			log.Println("failed to close dead-letter file cleanly:", err)
+		}
+	}
+	if producer != nil {
+		if err := producer.Close(); err != nil {
+			log.Println("failed to close Kafka producer cleanly:", err)
+		}
+	}
+}
+
+// routes returns the producer Routes for the configured routing rules. The
+// rules must have been validated.
+func routes(rules []config.Route) []output.Route {
+	var r []output.Route
+	for _, rule := range rules {
+		r = append(r, output.Route{Match: regexp.MustCompile(rule.Match), Topic: rule.Topic})
 	}
+	return r
+}
 
-	var b []byte
-	pretty, _ := isPretty(req)
-	if pretty {
-		b, _ = json.MarshalIndent(diagnostics, "", "    ")
-	} else {
-		b, _ = json.Marshal(diagnostics)
+// acl returns the ACL for the configured listener access. The access must
+// have been validated.
+func acl(a config.Access) *input.ACL {
+	if len(a.Allow) == 0 && len(a.Deny) == 0 {
+		return nil
 	}
-	w.Write(b)
+	return input.NewACL(cidrs(a.Allow), cidrs(a.Deny))
+}
+
+// tcpLimits returns the TcpLimits for the configured connection limits.
+func tcpLimits(c config.Connections) input.TcpLimits {
+	return input.TcpLimits{MaxConnections: c.Max, MaxPerIP: c.MaxPerIP, IdleTimeout: time.Duration(c.IdleTimeout) * time.Second}
+}
+
+// multiline returns the Multiline settings for the configured TCP
+// multi-line handling, which must have been validated.
+func multiline(m config.Multiline) input.Multiline {
+	patterns := make([]*regexp.Regexp, 0, len(m.Patterns))
+	for _, p := range m.Patterns {
+		patterns = append(patterns, regexp.MustCompile(p))
+	}
+	return input.Multiline{
+		FlushTimeout: time.Duration(m.FlushTimeout) * time.Millisecond,
+		MaxLines:     m.MaxLines,
+		Whitespace:   m.Whitespace,
+		Prefixes:     m.Prefixes,
+		Patterns:     patterns,
+	}
+}
+
+// cidrs returns the networks for the CIDRs, which must be valid.
+func cidrs(c []string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range c {
+		_, n, _ := net.ParseCIDR(cidr)
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+// rateRules returns the RateLimiter rules for the configured rate limits.
+// The rate limits must have been validated.
+func rateRules(limits []config.RateLimit) []pipeline.RateRule {
+	var r []pipeline.RateRule
+	for i, l := range limits {
+		action, _ := pipeline.ParseLimitAction(l.Action)
+		rule := pipeline.RateRule{Name: config.RuleName(i, l.Name), By: l.By, Rate: l.Rate, Burst: l.Burst, Action: action, Sample: l.Sample}
+		rule.Nets = cidrs(l.CIDRs)
+		r = append(r, rule)
+	}
+	return r
+}
+
+// filterRules returns the Filter rules for the configured filters. The
+// filters must have been validated.
+func filterRules(filters []config.Filter) []pipeline.FilterRule {
+	var r []pipeline.FilterRule
+	for i, f := range filters {
+		rule := pipeline.FilterRule{Name: config.RuleName(i, f.Name), Exclude: f.Action == "exclude"}
+		if f.Raw != "" {
+			rule.Raw = regexp.MustCompile(f.Raw)
+		}
+		rule.Fields = fieldPatterns(f.Fields)
+		r = append(r, rule)
+	}
+	return r
+}
+
+// fieldPatterns returns the compiled regular expressions for each field,
+// which must match the whole value of the field.
+func fieldPatterns(fields map[string]string) map[string]*regexp.Regexp {
+	if len(fields) == 0 {
+		return nil
+	}
+	patterns := make(map[string]*regexp.Regexp)
+	for name, re := range fields {
+		patterns[name] = regexp.MustCompile("^(?:" + re + ")$")
+	}
+	return patterns
+}
+
+// sampleRules returns the Sampler rules for the configured sampling rules.
+// The rules must have been validated.
+func sampleRules(samples []config.Sample) []pipeline.SampleRule {
+	var r []pipeline.SampleRule
+	for i, s := range samples {
+		r = append(r, pipeline.SampleRule{Name: config.RuleName(i, s.Name), Fields: fieldPatterns(s.Fields), Every: s.Every, Percent: s.Percent})
+	}
+	return r
+}
+
+// redactRules returns the Redactor rules for the configured redact rules.
+// The rules must have been validated.
+func redactRules(rules []config.Redact, key string) []pipeline.RedactRule {
+	var r []pipeline.RedactRule
+	for i, c := range rules {
+		rule, ok := pipeline.Builtin(c.Builtin)
+		if !ok {
+			rule.Match = regexp.MustCompile(c.Regex)
+		}
+		rule.Name = config.RuleName(i, c.Name, c.Builtin)
+		rule.Hash = c.Action == "hash"
+		rule.Key = []byte(key)
+		r = append(r, rule)
+	}
+	return r
+}
+
+// transform returns the Transform for the configured transform. The
+// transform must have been validated.
+func transform(c config.Transform) pipeline.Transform {
+	t := pipeline.Transform{KeyValue: c.KeyValue, Rename: c.Rename, Add: c.Add, Drop: c.Drop}
+	for _, re := range c.Regex {
+		t.Patterns = append(t.Patterns, regexp.MustCompile(re))
+	}
+	return t
 }
 
 func main() {
 	flag.Parse()
+	if configPath != "" {
+		if err := cfg.Load(configPath); err != nil {
+			fmt.Println("Failed to load configuration", err.Error())
+			os.Exit(1)
+		}
+		// Flags override the configuration file.
+		flag.Parse()
+	}
+	if err := cfg.Validate(); err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
 
 	startTime = time.Now()
 
@@ -155,61 +583,107 @@ func main() {
 		log.Fatal("unable to determine hostname -- aborting")
 	}
 	log.Printf("syslog server starting on %s, PID %d", hostname, os.Getpid())
+	log.Printf("version %s, commit %s, built with %s", version, commit, runtime.Version())
 	log.Printf("machine has %d cores", runtime.NumCPU())
 
 	// Log config
-	log.Println("Admin server:", adminIface)
-	log.Println("kafka brokers:", kBrokers)
-	log.Println("kafka topic:", kTopic)
-	log.Println("kafka batch size:", kBatch)
-	log.Println("kafka buffer time:", kBufferTime)
-	log.Println("kafka buffer bytes:", kBufferBytes)
-	log.Println("parsing enabled:", pEnabled)
-	log.Println("channel buffering capacity:", cCapacity)
+	log.Println("Admin server:", cfg.Admin)
+	log.Println("kafka brokers:", strings.Join(cfg.Output.Kafka.Brokers, ","))
+	log.Println("kafka topic:", cfg.Output.Kafka.Topic)
+	log.Println("kafka batch size:", cfg.Output.Kafka.Batch)
+	log.Println("kafka buffer time:", cfg.Output.Kafka.BufferTime)
+	log.Println("kafka buffer bytes:", cfg.Output.Kafka.BufferBytes)
+	log.Println("kafka routing rules:", len(cfg.Routing.Rules))
+	log.Println("parsing enabled:", cfg.Parser.Enabled)
+	log.Println("parser workers:", cfg.Parser.Workers)
+	log.Println("parser preserves per-source order:", cfg.Parser.Ordered)
+	log.Println("lenient parsing:", cfg.Parser.Lenient)
+	log.Println("timestamp layout:", cfg.Parser.TimestampLayout)
+	log.Println("max clock skew (secs):", cfg.Parser.MaxSkew)
+	log.Println("receive metadata:", cfg.Parser.Metadata)
+	log.Println("rate limits:", len(cfg.RateLimits))
+	log.Println("filter rules:", len(cfg.Filters))
+	log.Println("sampling rules:", len(cfg.Sampling))
+	log.Println("redact rules:", len(cfg.Redact))
+	log.Println("transform extracts key=value pairs:", cfg.Transform.KeyValue)
+	log.Println("dedup window (secs):", cfg.Dedup.Window)
+	log.Println("dead-letter topic:", cfg.DeadLetter.Topic)
+	log.Println("dead-letter file:", cfg.DeadLetter.File)
+	log.Println("channel buffering capacity:", cfg.Channels.Capacity)
+	log.Println("channel backpressure policy:", cfg.Channels.Policy)
+	log.Println("silence threshold (secs):", cfg.Silence.Threshold)
 
 	// Prep the channels
-	rawChan := make(chan string, cCapacity)
-	prodChan := make(chan string, cCapacity)
+	policy, _ := input.ParsePolicy(cfg.Channels.Policy)
+	rawQueue = input.NewQueue(cfg.Channels.Capacity, policy)
 
 	parser = input.NewRfc5424Parser()
-	if pEnabled {
-		// Feed the input through the Parser stage
-		prodChan, err = parser.StreamingParse(rawChan)
+	if cfg.Parser.Enabled {
+		// Feed the input through the Parser stage, once Kafka is connected.
+		prodQueue = input.NewQueue(cfg.Channels.Capacity, policy)
 	} else {
 		// Pass the input directly to the output
-		prodChan = rawChan
+		prodQueue = rawQueue
+	}
+	deadQueue = input.NewQueue(cfg.Channels.Capacity, policy)
+
+	// Prep the stages between the parser and the output
+	limiter = pipeline.NewRateLimiter(rateRules(cfg.RateLimits))
+	filter = pipeline.NewFilter(filterRules(cfg.Filters))
+	sampler = pipeline.NewSampler(sampleRules(cfg.Sampling))
+	redactor = pipeline.NewRedactor(redactRules(cfg.Redact, cfg.RedactKey))
+	transformer = pipeline.NewTransformer(transform(cfg.Transform))
+	dedup = pipeline.NewDedup(time.Duration(cfg.Dedup.Window)*time.Second, cfg.Dedup.Key)
+	peerLimiter = limiter.Peers()
+	toOutput = pipeline.Sink(prodQueue.Put, limiter.Parsed(), filter, sampler, redactor, transformer, dedup)
+
+	if cfg.DeadLetter.File != "" {
+		deadFile, err = output.NewFileWriter(cfg.DeadLetter.File)
+		if err != nil {
+			fmt.Println("Failed to open dead-letter file", err.Error())
+			os.Exit(1)
+		}
 	}
 
 	// Start the event servers
-	if tcpIface != "" {
-		tcpServer = input.NewTcpServer(tcpIface)
-		err = tcpServer.Start(func() chan<- string {
-			return rawChan
-		})
+	if cfg.Listeners.TCP != "" {
+		tcpServer, err = startTcpServer(cfg.Listeners.TCP, acl(cfg.Listeners.TCPAccess), tcpLimits(cfg.Listeners.TCPConnections), multiline(cfg.Listeners.TCPMultiline))
 		if err != nil {
 			fmt.Println("Failed to start TCP server", err.Error())
 			os.Exit(1)
 		}
-		log.Printf("listening on %s for TCP connections", tcpIface)
 	}
 
-	if udpIface != "" {
-		udpServer = input.NewUdpServer(udpIface)
-		err = udpServer.Start(func() chan<- string {
-			return rawChan
-		})
+	if cfg.Listeners.UDP != "" {
+		udpServer, err = startUdpServer(cfg.Listeners.UDP, acl(cfg.Listeners.UDPAccess))
 		if err != nil {
 			fmt.Println("Failed to start UDP server", err.Error())
 			os.Exit(1)
 		}
-		log.Printf("listening on %s for UDP packets", udpIface)
 	}
 
+	// Watch for hosts which stop sending logs
+	if cfg.Silence.Threshold > 0 {
+		monitor = input.NewSilenceMonitor(time.Duration(cfg.Silence.Threshold)*time.Second, int64(cfg.Silence.MinEvents), trackers()...)
+		monitor.Start(silenceInterval, rawInput)
+		log.Printf("alerting on hosts silent for more than %d seconds", cfg.Silence.Threshold)
+	}
+
+	// Report messages suppressed by rate limits and deduplication. Repeated
+	// messages have already passed through the other stages.
+	limiter.Start(summaryInterval, rawInput)
+	dedup.Start(dedupInterval, prodQueue.Put)
+
 	// Configure and start the Admin server
 	http.HandleFunc("/statistics", ServeStatistics)
 	http.HandleFunc("/diagnostics", ServeDiagnostics)
+	http.HandleFunc("/alerts", ServeAlerts)
+	http.HandleFunc("/failures", ServeFailures)
+	http.HandleFunc("/health", ServeHealth)
+	http.HandleFunc("/ready", ServeReady)
+	http.HandleFunc("/reload", ServeReload)
 	go func() {
-		err = http.ListenAndServe(adminIface, nil)
+		err = http.ListenAndServe(cfg.Admin, nil)
 		if err != nil {
 			fmt.Println("Failed to start admin server", err.Error())
 			os.Exit(1)
@@ -218,16 +692,62 @@ func main() {
 	log.Println("Admin server started")
 
 	// Connect to Kafka
-	log.Println("attempting to connect to Kafka brokers at:", kBrokers)
-	producer, err = output.NewKafkaProducer(strings.Split(kBrokers, ","), kTopic, kBufferTime, kBufferBytes, kBatch)
+	p, err := newProducer(cfg)
 	if err != nil {
 		fmt.Println("Failed to create Kafka producer", err.Error())
 		os.Exit(1)
 	}
-	log.Printf("connected to Kafka at %s", kBrokers)
+	mu.Lock()
+	producer = p
+	mu.Unlock()
 
-	// Write messages until program is terminated.
+	// Start parsing. Messages which cannot be parsed may need to be written
+	// to Kafka, so this must wait until Kafka is connected.
+	if cfg.Parser.Enabled {
+		parser.SetLenient(cfg.Parser.Lenient)
+		parser.SetRequireZone(cfg.Parser.RequireTimezone)
+		parser.SetMetadata(cfg.Parser.Metadata)
+		parser.SetTimestamp(cfg.Parser.TimestampLayout, time.Duration(cfg.Parser.MaxSkew)*time.Second)
+		parser.SetRedact(func(e *input.Event) { redactor.Process(e) })
+		if cfg.DeadLetter.File != "" || cfg.DeadLetter.Topic != "" {
+			parser.SetDeadLetter(deadLetter)
+		}
+		parser.StreamingParse(rawQueue.C, cfg.Parser.Workers, cfg.Parser.Ordered, toOutput)
+	}
+
+	// Reload the configuration on SIGHUP
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			log.Println("SIGHUP received, reloading configuration")
+			requestReload()
+		}
+	}()
+
+	// Flush buffered messages before exiting on SIGINT or SIGTERM.
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGINT, syscall.SIGTERM)
+
+	// Write messages until program is terminated. Reloads are applied
+	// between writes, so no message is lost while the producer is replaced.
 	for {
-		producer.Write(<-prodChan)
+		select {
+		case sig := <-term:
+			log.Println(sig, "received, shutting down")
+			shutdown()
+			return
+		case e := <-prodQueue.C:
+			b, err := e.Encode()
+			if err != nil {
+				log.Println("failed to encode event:", err)
+				continue
+			}
+			producer.Write(string(b))
+		case e := <-deadQueue.C:
+			producer.WriteTo(cfg.DeadLetter.Topic, e.Raw)
+		case r := <-reloads:
+			r <- reload()
+		}
 	}
 }
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/otoolep/syslog-gollector/config"
+	"github.com/otoolep/syslog-gollector/input"
+	. "gopkg.in/check.v1"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+type MainSuite struct{}
+
+var _ = Suite(&MainSuite{})
+
+func (s *MainSuite) SetUpTest(c *C) {
+	cfg = config.Default()
+	startTime = time.Now()
+	tcpServer = nil
+	udpServer = nil
+	rawQueue, prodQueue, deadQueue = nil, nil, nil
+}
+
+func (s *MainSuite) TearDownTest(c *C) {
+	if tcpServer != nil {
+		tcpServer.Stop()
+	}
+}
+
+func (s *MainSuite) Test_Diagnostics(c *C) {
+	cfg.Output.Kafka.Batch = 50
+	cfg.RedactKey = "secret"
+
+	w := httptest.NewRecorder()
+	ServeDiagnostics(w, httptest.NewRequest("GET", "/diagnostics", nil))
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(w.Header().Get("Content-Type"), Equals, "application/json")
+	c.Assert(strings.Contains(w.Body.String(), "secret"), Equals, false)
+
+	var d Diagnostics
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &d), IsNil)
+	c.Assert(d.Started.Equal(startTime), Equals, true)
+	c.Assert(d.Version, Equals, version)
+	c.Assert(d.GOMAXPROCS > 0, Equals, true)
+	c.Assert(d.Goroutines > 0, Equals, true)
+	c.Assert(d.Memory.Sys > 0, Equals, true)
+	c.Assert(d.Listeners, HasLen, 0)
+	c.Assert(d.Config.Output.Kafka.Batch, Equals, 50)
+	c.Assert(d.Config.Output.Kafka.Brokers, DeepEquals, []string{"localhost:9092"})
+	c.Assert(d.Config.RedactKey, Not(Equals), "secret")
+}
+
+func (s *MainSuite) Test_DiagnosticsListeners(c *C) {
+	tcpServer = input.NewTcpServer("127.0.0.1:0")
+	c.Assert(tcpServer.Start(rawInput), IsNil)
+
+	w := httptest.NewRecorder()
+	ServeDiagnostics(w, httptest.NewRequest("GET", "/diagnostics", nil))
+
+	var d Diagnostics
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &d), IsNil)
+	c.Assert(d.Listeners["tcp"], Equals, tcpServer.Addr().String())
+}
+
+func (s *MainSuite) Test_DiagnosticsPretty(c *C) {
+	w := httptest.NewRecorder()
+	ServeDiagnostics(w, httptest.NewRequest("GET", "/diagnostics?pretty", nil))
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(strings.Contains(w.Body.String(), "\n    \"started\""), Equals, true)
+}
+
+// readiness is the body returned by ServeReady.
+type readiness struct {
+	Ready  bool             `json:"ready"`
+	Checks map[string]check `json:"checks"`
+}
+
+func (s *MainSuite) Test_Health(c *C) {
+	w := httptest.NewRecorder()
+	ServeHealth(w, httptest.NewRequest("GET", "/health", nil))
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(w.Header().Get("Content-Type"), Equals, "application/json")
+	c.Assert(w.Body.String(), Equals, `{"status":"ok"}`)
+}
+
+func (s *MainSuite) Test_QueueCheck(c *C) {
+	c.Assert(queueCheck(nil), Equals, check{false, "not created"})
+	c.Assert(queueCheck(input.NewQueue(0, input.Block)), Equals, check{true, "unbuffered, saturation does not apply"})
+
+	q := input.NewQueue(2, input.Block)
+	q.Put(input.NewEvent("<134>1 - host app 1 - one", ""))
+	c.Assert(queueCheck(q), Equals, check{true, "1 of 2 buffered"})
+	q.Put(input.NewEvent("<134>1 - host app 1 - two", ""))
+	c.Assert(queueCheck(q), Equals, check{false, "saturated, 2 of 2 buffered"})
+}
+
+func (s *MainSuite) Test_KafkaCheck(c *C) {
+	c.Assert(kafkaCheck(nil), Equals, check{false, "not connected to localhost:9092"})
+	c.Assert(kafkaCheck(func() (time.Time, error) { return time.Time{}, nil }), Equals, check{true, "connected to localhost:9092"})
+
+	recent := func() (time.Time, error) { return time.Now(), errors.New("leader not available") }
+	r := kafkaCheck(recent)
+	c.Assert(r.OK, Equals, false)
+	c.Assert(strings.HasSuffix(r.Reason, ": leader not available"), Equals, true, Commentf(r.Reason))
+
+	old := func() (time.Time, error) {
+		return time.Now().Add(-2 * readyErrorWindow), errors.New("leader not available")
+	}
+	c.Assert(kafkaCheck(old).OK, Equals, true)
+}
+
+func (s *MainSuite) Test_Ready(c *C) {
+	cfg.Listeners.TCP, cfg.Listeners.UDP = "127.0.0.1:0", ""
+	rawQueue = input.NewQueue(1, input.Block)
+	prodQueue = rawQueue
+	rawQueue.Put(input.NewEvent("<134>1 - host app 1 - one", ""))
+
+	w := httptest.NewRecorder()
+	ServeReady(w, httptest.NewRequest("GET", "/ready", nil))
+	c.Assert(w.Code, Equals, http.StatusServiceUnavailable)
+	c.Assert(w.Header().Get("Content-Type"), Equals, "application/json")
+
+	var r readiness
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &r), IsNil)
+	c.Assert(r.Ready, Equals, false)
+	c.Assert(r.Checks, HasLen, 4)
+	c.Assert(r.Checks["tcp"], Equals, check{false, "not listening on 127.0.0.1:0"})
+	c.Assert(r.Checks["kafka"], Equals, check{false, "not connected to localhost:9092"})
+	c.Assert(r.Checks["rawQueue"], Equals, check{false, "saturated, 1 of 1 buffered"})
+
+	// Once bound and drained, only the producer is failing.
+	tcpServer = input.NewTcpServer(cfg.Listeners.TCP)
+	c.Assert(tcpServer.Start(rawInput), IsNil)
+	<-rawQueue.C
+
+	w = httptest.NewRecorder()
+	ServeReady(w, httptest.NewRequest("GET", "/ready", nil))
+	c.Assert(w.Code, Equals, http.StatusServiceUnavailable)
+	r = readiness{}
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &r), IsNil)
+	c.Assert(r.Checks["tcp"], Equals, check{true, "listening on " + tcpServer.Addr().String()})
+	c.Assert(r.Checks["rawQueue"], Equals, check{true, "0 of 1 buffered"})
+	c.Assert(r.Checks["kafka"].OK, Equals, false)
+}
+
+func (s *MainSuite) Test_ReadyChecks(c *C) {
+	tests := []struct {
+		name   string
+		checks map[string]check
+		code   int
+	}{
+		{"all pass", map[string]check{"tcp": {true, "listening"}, "kafka": {true, "connected"}}, http.StatusOK},
+		{"listener not bound", map[string]check{"tcp": {false, "not listening"}, "kafka": {true, "connected"}}, http.StatusServiceUnavailable},
+		{"producer erroring", map[string]check{"tcp": {true, "listening"}, "kafka": {false, "error"}}, http.StatusServiceUnavailable},
+		{"queue saturated", map[string]check{"kafka": {true, "connected"}, "rawQueue": {false, "saturated"}}, http.StatusServiceUnavailable},
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		serveChecks(w, httptest.NewRequest("GET", "/ready", nil), tt.checks)
+		c.Assert(w.Code, Equals, tt.code, Commentf(tt.name))
+
+		var r readiness
+		c.Assert(json.Unmarshal(w.Body.Bytes(), &r), IsNil, Commentf(tt.name))
+		c.Assert(r.Ready, Equals, tt.code == http.StatusOK, Commentf(tt.name))
+		c.Assert(r.Checks, DeepEquals, tt.checks, Commentf(tt.name))
+	}
+}
+
+func (s *MainSuite) Test_ReadyPretty(c *C) {
+	w := httptest.NewRecorder()
+	serveChecks(w, httptest.NewRequest("GET", "/ready?pretty", nil), map[string]check{"kafka": {true, "connected"}})
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(strings.Contains(w.Body.String(), "\n    \"checks\""), Equals, true)
+}